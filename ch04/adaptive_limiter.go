@@ -0,0 +1,312 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrConcurrencyLimit は、同時実行数の上限に達したため呼び出しが拒否されたことを表すエラーです。
+// ConcurrencyLimitError は errors.Is でこのエラーと比較できます。
+var ErrConcurrencyLimit = errors.New("concurrency limit exceeded")
+
+// ConcurrencyLimitError は、同時実行数の上限に達したため呼び出しが拒否されたときに返されるエラーです。
+type ConcurrencyLimitError struct {
+	Limit    int // 拒否した時点の上限
+	InFlight int // 拒否した時点の実行中の呼び出しの数
+}
+
+func (e *ConcurrencyLimitError) Error() string {
+	return fmt.Sprintf("%v: %d in flight, limit %d", ErrConcurrencyLimit, e.InFlight, e.Limit)
+}
+
+// Is は target が ErrConcurrencyLimit であれば true を返します。
+func (e *ConcurrencyLimitError) Is(target error) bool {
+	return target == ErrConcurrencyLimit
+}
+
+// LimitAlgorithm は、呼び出しの計測結果から新しい同時実行数の上限を計算します。
+// Update は AdaptiveLimiter のロックを保持した状態で呼び出されるため、
+// 実装が状態を持つ場合でも自分でロックする必要はありません。
+type LimitAlgorithm interface {
+	// Update は、現在の上限 limit、呼び出し開始時の実行中の数 inFlight、
+	// 所要時間 rtt、失敗したかどうか dropped から新しい上限を返します。
+	Update(limit, inFlight int, rtt time.Duration, dropped bool) int
+}
+
+// clampLimit は limit を [lo, hi] の範囲に収めます。
+// lo と hi が 0 以下の場合はそれぞれ 1 と 1000 を使います。
+func clampLimit(limit, lo, hi int) int {
+	if lo <= 0 {
+		lo = 1
+	}
+	if hi <= 0 {
+		hi = 1000
+	}
+	return max(lo, min(limit, hi))
+}
+
+// AIMD は、成功するたびに上限を1ずつ増やし、失敗すると BackoffRatio 倍に減らします
+// (Additive Increase / Multiplicative Decrease)。Timeout より遅い呼び出しも失敗とみなします。
+type AIMD struct {
+	MinLimit int // 既定値は 1
+	MaxLimit int // 既定値は 1000
+
+	BackoffRatio float64       // 既定値は 0.9
+	Timeout      time.Duration // 0 の場合は所要時間で失敗とみなしません
+}
+
+func (a *AIMD) Update(limit, inFlight int, rtt time.Duration, dropped bool) int {
+	if dropped || (a.Timeout > 0 && rtt > a.Timeout) {
+		ratio := a.BackoffRatio
+		if ratio <= 0 || ratio >= 1 {
+			ratio = 0.9
+		}
+		return clampLimit(int(float64(limit)*ratio), a.MinLimit, a.MaxLimit)
+	}
+
+	if inFlight*2 >= limit { // 上限の半分も使っていなければ増やさない
+		return clampLimit(limit+1, a.MinLimit, a.MaxLimit)
+	}
+
+	return limit
+}
+
+// Vegas は、観測した最小の所要時間を負荷のない状態の所要時間とみなし、そこからの遅れで
+// 推定した待ち行列の長さが Alpha 未満なら上限を増やし、Beta を超えたら減らします (TCP Vegas 方式)。
+type Vegas struct {
+	MinLimit int // 既定値は 1
+	MaxLimit int // 既定値は 1000
+
+	Alpha int // 既定値は 3
+	Beta  int // 既定値は 6
+
+	noLoadRTT time.Duration
+}
+
+func (v *Vegas) Update(limit, inFlight int, rtt time.Duration, dropped bool) int {
+	decrease := max(1, int(math.Log10(float64(limit))))
+
+	if dropped {
+		return clampLimit(limit-decrease, v.MinLimit, v.MaxLimit)
+	}
+
+	if v.noLoadRTT == 0 || rtt < v.noLoadRTT {
+		v.noLoadRTT = rtt
+	}
+
+	if inFlight*2 < limit || rtt <= 0 {
+		return limit
+	}
+
+	alpha, beta := v.Alpha, v.Beta
+	if alpha <= 0 {
+		alpha = 3
+	}
+	if beta <= alpha {
+		beta = max(6, alpha+1)
+	}
+
+	queue := int(math.Ceil(float64(limit) * (1 - float64(v.noLoadRTT)/float64(rtt))))
+
+	switch {
+	case queue < alpha:
+		return clampLimit(limit+1, v.MinLimit, v.MaxLimit)
+	case queue > beta:
+		return clampLimit(limit-decrease, v.MinLimit, v.MaxLimit)
+	default:
+		return limit
+	}
+}
+
+// Gradient は、所要時間の長期の指数移動平均と直近の所要時間の比 (勾配) を上限に掛け、
+// 平方根分の余裕を加えて新しい上限を求めます。勾配は 0.5 から 1 に制限され、
+// 所要時間が長期平均の Tolerance 倍までは遅くなったとみなしません。
+type Gradient struct {
+	MinLimit int // 既定値は 1
+	MaxLimit int // 既定値は 1000
+
+	Tolerance float64 // 既定値は 1.5
+	Smoothing float64 // 上限の変化を平滑化する係数。既定値は 0.2
+
+	longRTT float64 // 所要時間の長期の指数移動平均
+	limit   float64 // 平滑化した上限
+}
+
+// gradientLongWindow は所要時間の長期の指数移動平均の係数です。
+const gradientLongWindow = 0.05
+
+func (g *Gradient) Update(limit, inFlight int, rtt time.Duration, dropped bool) int {
+	if g.limit == 0 {
+		g.limit = float64(limit)
+	}
+
+	if dropped {
+		g.limit = float64(clampLimit(int(g.limit/2), g.MinLimit, g.MaxLimit))
+		return int(g.limit)
+	}
+
+	short := float64(rtt)
+	if g.longRTT == 0 {
+		g.longRTT = short
+	} else {
+		g.longRTT = g.longRTT*(1-gradientLongWindow) + short*gradientLongWindow
+	}
+
+	if inFlight*2 < limit || short <= 0 {
+		return limit
+	}
+
+	tolerance := g.Tolerance
+	if tolerance <= 0 {
+		tolerance = 1.5
+	}
+	smoothing := g.Smoothing
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+
+	gradient := max(0.5, min(1.0, tolerance*g.longRTT/short))
+	next := g.limit*gradient + math.Sqrt(g.limit)
+
+	g.limit = g.limit*(1-smoothing) + next*smoothing
+	g.limit = float64(clampLimit(int(math.Round(g.limit)), g.MinLimit, g.MaxLimit))
+
+	return int(g.limit)
+}
+
+// AdaptiveLimiterSettings は AdaptiveLimiter の設定です。
+type AdaptiveLimiterSettings struct {
+	// InitialLimit は同時実行数の上限の初期値です。既定値は 20 です。
+	InitialLimit int
+
+	// Algorithm は上限を調整するアルゴリズムです。nil の場合は AIMD を使います。
+	Algorithm LimitAlgorithm
+
+	// Classifier はエラーを失敗として扱うかどうか分類します。nil の場合は、
+	// context.Canceled を OutcomeIgnore とし、それ以外を DefaultClassifier で分類します。
+	// OutcomeIgnore の呼び出しは計測しません。
+	Classifier Classifier
+}
+
+// adaptiveClassifier は AdaptiveLimiter の既定の Classifier です。
+// 呼び出し側が取り消した呼び出しは下流の状態を表さないため、上限の計算に含めません。
+func adaptiveClassifier(err error) Outcome {
+	if errors.Is(err, context.Canceled) {
+		return OutcomeIgnore
+	}
+	return DefaultClassifier(err)
+}
+
+// AdaptiveLimiter は、同時に実行中の呼び出しの数を制限し、その上限を呼び出しの
+// 所要時間と失敗から自動的に調整するリミッターです。下流が遅くなると上限が下がり、
+// 超過した呼び出しは ConcurrencyLimitError で拒否されます。
+type AdaptiveLimiter struct {
+	settings AdaptiveLimiterSettings
+
+	m        sync.Mutex
+	limit    int
+	inFlight int
+}
+
+// NewAdaptiveLimiter は、指定された設定で AdaptiveLimiter を作成します。
+func NewAdaptiveLimiter(settings AdaptiveLimiterSettings) *AdaptiveLimiter {
+	if settings.InitialLimit <= 0 {
+		settings.InitialLimit = 20
+	}
+	if settings.Algorithm == nil {
+		settings.Algorithm = &AIMD{}
+	}
+	if settings.Classifier == nil {
+		settings.Classifier = adaptiveClassifier
+	}
+
+	return &AdaptiveLimiter{settings: settings, limit: settings.InitialLimit}
+}
+
+// Limit は現在の同時実行数の上限を返します。
+func (l *AdaptiveLimiter) Limit() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.limit
+}
+
+// InFlight は実行中の呼び出しの数を返します。
+func (l *AdaptiveLimiter) InFlight() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.inFlight
+}
+
+// Wrap は、AdaptiveLimiter で同時実行数を制限した Effector を返します。
+func (l *AdaptiveLimiter) Wrap(e Effector) Effector {
+	return Effector(untyped(LimitConcurrencyOf(l, e.typed())))
+}
+
+// LimitConcurrencyOf は、AdaptiveLimiter で同時実行数を制限した CircuitOf を返します。
+func LimitConcurrencyOf[Req, Resp any](l *AdaptiveLimiter, e CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+	return func(ctx context.Context, req Req) (Resp, error) {
+		inFlight, err := l.acquire()
+		if err != nil {
+			var zero Resp
+			return zero, err
+		}
+
+		start := time.Now()
+		response, err := e(ctx, req)
+		l.release(inFlight, time.Since(start), err)
+
+		return response, err
+	}
+}
+
+// acquire は上限に余裕があれば実行中の数を増やし、増やした後の数を返します。
+func (l *AdaptiveLimiter) acquire() (int, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.inFlight >= l.limit {
+		return 0, &ConcurrencyLimitError{Limit: l.limit, InFlight: l.inFlight}
+	}
+
+	l.inFlight++
+
+	return l.inFlight, nil
+}
+
+// release は実行中の数を減らし、計測結果で上限を更新します。
+func (l *AdaptiveLimiter) release(inFlight int, rtt time.Duration, err error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.inFlight--
+
+	result := l.settings.Classifier(err)
+	if result == OutcomeIgnore {
+		return
+	}
+
+	dropped := result == OutcomeFailure || result == OutcomePermanent
+	l.limit = l.settings.Algorithm.Update(l.limit, inFlight, rtt, dropped)
+}
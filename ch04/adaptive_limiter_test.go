@@ -0,0 +1,159 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAIMD tests additive increase and multiplicative decrease.
+func TestAIMD(t *testing.T) {
+	a := &AIMD{MaxLimit: 11, Timeout: time.Second}
+
+	if got := a.Update(10, 10, time.Millisecond, false); got != 11 {
+		t.Error("expected 11; got", got)
+	}
+	if got := a.Update(11, 11, time.Millisecond, false); got != 11 {
+		t.Error("expected MaxLimit 11; got", got)
+	}
+	if got := a.Update(10, 2, time.Millisecond, false); got != 10 {
+		t.Error("expected no increase while underused; got", got)
+	}
+	if got := a.Update(10, 10, time.Millisecond, true); got != 9 {
+		t.Error("expected 9 after a drop; got", got)
+	}
+	if got := a.Update(10, 10, 2*time.Second, false); got != 9 {
+		t.Error("expected 9 after a timeout; got", got)
+	}
+}
+
+// TestVegas tests that the limit grows while latency stays at the no-load
+// level and shrinks when latency rises.
+func TestVegas(t *testing.T) {
+	v := &Vegas{}
+
+	if got := v.Update(20, 20, 10*time.Millisecond, false); got != 21 {
+		t.Error("expected 21; got", got)
+	}
+	if got := v.Update(20, 20, 100*time.Millisecond, false); got >= 20 {
+		t.Error("expected a decrease; got", got)
+	}
+}
+
+// TestGradient tests that the limit shrinks when latency rises above the
+// long-term average.
+func TestGradient(t *testing.T) {
+	g := &Gradient{}
+
+	limit := 20
+	for i := 0; i < 20; i++ {
+		limit = g.Update(limit, limit, 10*time.Millisecond, false)
+	}
+	grown := limit
+	if grown <= 20 {
+		t.Fatal("expected the limit to grow at steady latency; got", grown)
+	}
+
+	for i := 0; i < 20; i++ {
+		limit = g.Update(limit, limit, 100*time.Millisecond, false)
+	}
+	if limit >= grown {
+		t.Errorf("expected the limit to shrink below %d; got %d", grown, limit)
+	}
+}
+
+// TestAdaptiveLimiterRejects tests that calls beyond the limit are rejected
+// with a ConcurrencyLimitError.
+func TestAdaptiveLimiterRejects(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveLimiterSettings{InitialLimit: 2})
+
+	release := make(chan struct{})
+	limited := l.Wrap(func(ctx context.Context) (string, error) {
+		<-release
+		return "done", nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limited(context.Background())
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := limited(context.Background())
+
+	var lerr *ConcurrencyLimitError
+	if !errors.As(err, &lerr) || !errors.Is(err, ErrConcurrencyLimit) {
+		t.Fatal("expected a ConcurrencyLimitError; got", err)
+	}
+	if lerr.Limit != 2 || lerr.InFlight != 2 {
+		t.Errorf("unexpected error details: %+v", lerr)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if l.InFlight() != 0 {
+		t.Error("expected nothing in flight; got", l.InFlight())
+	}
+}
+
+// TestAdaptiveLimiterShedsLoad tests that failures lower the limit.
+func TestAdaptiveLimiterShedsLoad(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveLimiterSettings{InitialLimit: 20})
+
+	limited := LimitConcurrencyOf(l, func(ctx context.Context, _ int) (string, error) {
+		return "", errors.New("INTENTIONAL FAIL!")
+	})
+
+	for i := 0; i < 10; i++ {
+		limited(context.Background(), i)
+	}
+
+	if l.Limit() >= 20 {
+		t.Error("expected the limit to drop below 20; got", l.Limit())
+	}
+}
+
+// TestAdaptiveLimiterIgnoresCanceled tests that calls cancelled by the
+// caller don't lower the limit.
+func TestAdaptiveLimiterIgnoresCanceled(t *testing.T) {
+	l := NewAdaptiveLimiter(AdaptiveLimiterSettings{InitialLimit: 20})
+
+	limited := LimitConcurrencyOf(l, func(ctx context.Context, _ int) (string, error) {
+		return "", ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < 10; i++ {
+		limited(ctx, i)
+	}
+
+	if l.Limit() != 20 {
+		t.Error("expected the limit to stay at 20; got", l.Limit())
+	}
+}
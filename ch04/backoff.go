@@ -0,0 +1,132 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff は、失敗が続いたときの待機時間を決める戦略です。
+// 実装は状態を持たず、複数のゴルーチンから同時に使用できる必要があります。
+type Backoff interface {
+	// Next は attempt 回目 (0 始まり) の失敗の後に待機する時間を返します。
+	// prev には直前に返した待機時間が渡されます。最初の呼び出しでは 0 です。
+	Next(attempt int, prev time.Duration) time.Duration
+}
+
+// ConstantBackoff は常に Delay だけ待機します。
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+func (b ConstantBackoff) Next(int, time.Duration) time.Duration {
+	return b.Delay
+}
+
+// LinearBackoff は Initial から Step ずつ待機時間を増やします。
+// Max が 0 より大きい場合、待機時間は Max を超えません。
+type LinearBackoff struct {
+	Initial time.Duration
+	Step    time.Duration
+	Max     time.Duration
+}
+
+func (b LinearBackoff) Next(attempt int, _ time.Duration) time.Duration {
+	return capDelay(b.Initial+time.Duration(attempt)*b.Step, b.Max)
+}
+
+// ExponentialBackoff は Initial から Multiplier 倍ずつ待機時間を増やします。
+// Multiplier が 1 以下の場合は 2 倍にします。
+// Max が 0 より大きい場合、待機時間は Max を超えません。
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Multiplier float64
+	Max        time.Duration
+}
+
+func (b ExponentialBackoff) Next(attempt int, _ time.Duration) time.Duration {
+	return capDelay(exponential(b.Initial, b.Multiplier, attempt, b.Max), b.Max)
+}
+
+// FullJitterBackoff は、0 から Base*2^attempt (Max が上限) までの一様乱数だけ待機します。
+// 多数のクライアントが同時にリトライすることを避けられます。
+type FullJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b FullJitterBackoff) Next(attempt int, _ time.Duration) time.Duration {
+	return randomBetween(0, capDelay(exponential(b.Base, 2, attempt, b.Max), b.Max))
+}
+
+// DecorrelatedJitterBackoff は、Base から直前の待機時間の3倍 (Max が上限) までの
+// 一様乱数だけ待機します。
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+func (b DecorrelatedJitterBackoff) Next(_ int, prev time.Duration) time.Duration {
+	if prev < b.Base {
+		prev = b.Base
+	}
+	return capDelay(randomBetween(b.Base, 3*prev), b.Max)
+}
+
+// defaultBreakerBackoff は Breaker の既定の待機時間で、2秒から倍々に増やします。
+var defaultBreakerBackoff Backoff = ExponentialBackoff{Initial: 2 * time.Second, Multiplier: 2}
+
+// exponential は initial*multiplier^attempt を返します。
+// 計算の途中で limit (0 より大きい場合) を超えた時点で打ち切ります。
+func exponential(initial time.Duration, multiplier float64, attempt int, limit time.Duration) time.Duration {
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+
+	d := float64(initial)
+	for i := 0; i < attempt; i++ {
+		d *= multiplier
+		if (limit > 0 && d >= float64(limit)) || d >= float64(maxDuration) {
+			break
+		}
+	}
+
+	if d >= float64(maxDuration) {
+		return maxDuration
+	}
+	return time.Duration(d)
+}
+
+// maxDuration は time.Duration で表現できる最大の値です。
+const maxDuration = time.Duration(1<<63 - 1)
+
+// capDelay は d を max (0 より大きい場合) 以下に制限します。
+func capDelay(d, max time.Duration) time.Duration {
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
+// randomBetween は [lo, hi) の一様乱数を返します。hi <= lo の場合は lo を返します。
+func randomBetween(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	return lo + time.Duration(rand.Int64N(int64(hi-lo)))
+}
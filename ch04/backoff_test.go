@@ -0,0 +1,150 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBackoffDelays tests the delays produced by the deterministic backoff
+// strategies, including the Max cap.
+func TestBackoffDelays(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		want    []time.Duration
+	}{
+		{"constant", ConstantBackoff{Delay: time.Second},
+			[]time.Duration{time.Second, time.Second, time.Second}},
+		{"linear", LinearBackoff{Initial: time.Second, Step: time.Second, Max: 2500 * time.Millisecond},
+			[]time.Duration{time.Second, 2 * time.Second, 2500 * time.Millisecond}},
+		{"exponential", ExponentialBackoff{Initial: time.Second, Multiplier: 3, Max: 5 * time.Second},
+			[]time.Duration{time.Second, 3 * time.Second, 5 * time.Second}},
+		{"breaker default", defaultBreakerBackoff,
+			[]time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prev time.Duration
+			for attempt, want := range tt.want {
+				prev = tt.backoff.Next(attempt, prev)
+				if prev != want {
+					t.Errorf("attempt %d: expected %v; got %v", attempt, want, prev)
+				}
+			}
+		})
+	}
+}
+
+// TestBackoffJitter tests that the jittered strategies stay within their
+// bounds.
+func TestBackoffJitter(t *testing.T) {
+	full := FullJitterBackoff{Base: 100 * time.Millisecond, Max: time.Second}
+	decorrelated := DecorrelatedJitterBackoff{Base: 100 * time.Millisecond, Max: time.Second}
+
+	var prev time.Duration
+	for attempt := 0; attempt < 100; attempt++ {
+		if d := full.Next(attempt, 0); d < 0 || d >= time.Second {
+			t.Errorf("full jitter attempt %d out of range: %v", attempt, d)
+		}
+
+		d := decorrelated.Next(attempt, prev)
+		if d < 100*time.Millisecond || d > time.Second || d > 3*max(prev, 100*time.Millisecond) {
+			t.Errorf("decorrelated jitter attempt %d out of range: %v (prev %v)", attempt, d, prev)
+		}
+		prev = d
+	}
+}
+
+// TestRetryBackoff tests that Retry waits according to its Backoff.
+func TestRetryBackoff(t *testing.T) {
+	attempts := 0
+	r := RetryWith(func(ctx context.Context, _ struct{}) (string, error) {
+		attempts++
+		if attempts < 4 {
+			return "", errors.New("error")
+		}
+		return "success", nil
+	}, RetryOptions{
+		Retries: 5,
+		Backoff: LinearBackoff{Initial: 10 * time.Millisecond, Step: 20 * time.Millisecond},
+	})
+
+	start := time.Now()
+	if _, err := r(context.Background(), struct{}{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// 10ms + 30ms + 50ms
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Error("expected at least 90ms; got", elapsed)
+	}
+}
+
+// TestRetryMaxElapsed tests that Retry gives up once the next delay would
+// exceed the elapsed-time budget.
+func TestRetryMaxElapsed(t *testing.T) {
+	attempts := 0
+	r := RetryWith(func(ctx context.Context, _ struct{}) (string, error) {
+		attempts++
+		return "", errors.New("error")
+	}, RetryOptions{
+		Unlimited:  true,
+		Backoff:    ConstantBackoff{Delay: 40 * time.Millisecond},
+		MaxElapsed: 100 * time.Millisecond,
+	})
+
+	if _, err := r(context.Background(), struct{}{}); err == nil {
+		t.Error("expected an error")
+	}
+
+	if attempts != 3 {
+		t.Error("expected 3 attempts; got", attempts)
+	}
+}
+
+// TestCircuitBreakerOpenBackoff tests that the open duration grows with
+// consecutive reopens.
+func TestCircuitBreakerOpenBackoff(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold: 1,
+		OpenBackoff:      ExponentialBackoff{Initial: 50 * time.Millisecond, Multiplier: 4},
+	})
+
+	circuit := cb.Wrap(failAfter(0))
+	ctx := context.Background()
+
+	circuit(ctx)
+	time.Sleep(75 * time.Millisecond)
+	circuit(ctx) // the failed probe reopens the circuit for 200ms
+
+	time.Sleep(75 * time.Millisecond)
+
+	if cb.State() != StateOpen {
+		t.Error("expected open; got", cb.State())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if cb.State() != StateHalfOpen {
+		t.Error("expected half-open; got", cb.State())
+	}
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// State は CircuitBreaker の状態を表します。
+type State int
+
+const (
+	StateClosed   State = iota // 通常どおり呼び出しを通す状態
+	StateOpen                  // 全ての呼び出しを拒否する状態
+	StateHalfOpen              // 限られた数の試行で回復を確認する状態
+)
+
+// String は状態の名前を返します。
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerSettings は CircuitBreaker の設定です。
+// ゼロ値のフィールドには NewCircuitBreaker が既定値を設定します。
+type CircuitBreakerSettings struct {
+	// Name は OnStateChange に渡される識別名です。
+	Name string
+
+	// FailureThreshold は、閉状態から開状態に遷移する連続失敗回数です。既定値は 5 です。
+	// WindowSize か WindowDuration が設定されている場合は使用されません。
+	FailureThreshold int
+
+	// WindowSize が 0 より大きい場合、直近 WindowSize 回の呼び出しの
+	// 失敗率と遅い呼び出しの割合で開状態への遷移を判定します。
+	WindowSize int
+
+	// WindowDuration が 0 より大きい場合、直近 WindowDuration の間の呼び出しの
+	// 失敗率と遅い呼び出しの割合で開状態への遷移を判定します。WindowSize より優先されます。
+	WindowDuration time.Duration
+
+	// MinimumCalls は、ウィンドウで判定を行うために必要な最小の呼び出し回数です。
+	// 既定値は、WindowSize を使う場合は WindowSize、WindowDuration を使う場合は 10 です。
+	MinimumCalls int
+
+	// FailureRateThreshold は、開状態に遷移する失敗率 (パーセント) です。既定値は 50 です。
+	FailureRateThreshold float64
+
+	// SlowCallDuration は、遅い呼び出しとみなす所要時間です。0 の場合は判定しません。
+	SlowCallDuration time.Duration
+
+	// SlowCallRateThreshold は、開状態に遷移する遅い呼び出しの割合 (パーセント) です。既定値は 100 です。
+	SlowCallRateThreshold float64
+
+	// OpenTimeout は、開状態から半開状態に遷移するまでの時間です。既定値は 60 秒です。
+	OpenTimeout time.Duration
+
+	// OpenBackoff が設定されている場合、開状態の時間を OpenTimeout の代わりに OpenBackoff で決めます。
+	// attempt には、閉状態に戻らずに開状態になった回数 (0 始まり) が渡されます。
+	OpenBackoff Backoff
+
+	// HalfOpenMaxCalls は、半開状態で同時に許可する試行の数です。既定値は 1 です。
+	HalfOpenMaxCalls int
+
+	// SuccessThreshold は、半開状態から閉状態に戻るために必要な成功回数です。既定値は 1 です。
+	SuccessThreshold int
+
+	// Classifier はエラーを失敗として数えるかどうか分類します。
+	// nil の場合は DefaultClassifier を使います。
+	Classifier Classifier
+
+	// OnStateChange は状態が遷移するたびに呼び出されます。
+	OnStateChange func(name string, from, to State)
+}
+
+// CircuitBreaker は、閉・開・半開の3つの状態を持つサーキットブレーカーです。
+// 開状態では呼び出しを即座に拒否し、OpenTimeout の経過後は半開状態で
+// HalfOpenMaxCalls 個までの試行を通して回復を確認します。
+type CircuitBreaker struct {
+	settings CircuitBreakerSettings
+	window   slidingWindow // nil の場合は連続失敗回数で判定する
+
+	m          sync.Mutex
+	state      State
+	generation uint64 // 状態が変わるたびに進み、古い呼び出しの結果を無視するために使う
+	failures   int    // 閉状態での連続失敗回数
+	successes  int    // 半開状態での成功回数
+	probes     int    // 半開状態で実行中の試行数
+	opens      int    // 閉状態に戻らずに開状態になった回数
+	openedAt   time.Time
+	openFor    time.Duration // 現在の開状態を続ける時間
+}
+
+// NewCircuitBreaker は、指定された設定で閉状態の CircuitBreaker を作成します。
+func NewCircuitBreaker(settings CircuitBreakerSettings) *CircuitBreaker {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = 5
+	}
+	if settings.OpenTimeout <= 0 {
+		settings.OpenTimeout = 60 * time.Second
+	}
+	if settings.HalfOpenMaxCalls <= 0 {
+		settings.HalfOpenMaxCalls = 1
+	}
+	if settings.SuccessThreshold <= 0 {
+		settings.SuccessThreshold = 1
+	}
+
+	var window slidingWindow
+	switch {
+	case settings.WindowDuration > 0:
+		window = newTimeWindow(settings.WindowDuration)
+		if settings.MinimumCalls <= 0 {
+			settings.MinimumCalls = 10
+		}
+	case settings.WindowSize > 0:
+		window = newCountWindow(settings.WindowSize)
+		if settings.MinimumCalls <= 0 {
+			settings.MinimumCalls = settings.WindowSize
+		}
+	}
+	if settings.FailureRateThreshold <= 0 {
+		settings.FailureRateThreshold = 50
+	}
+	if settings.SlowCallRateThreshold <= 0 {
+		settings.SlowCallRateThreshold = 100
+	}
+
+	return &CircuitBreaker{settings: settings, window: window}
+}
+
+// Name は CircuitBreaker の識別名を返します。
+func (cb *CircuitBreaker) Name() string {
+	return cb.settings.Name
+}
+
+// State は現在の状態を返します。
+// 開状態で OpenTimeout が経過している場合は半開状態を返します。
+func (cb *CircuitBreaker) State() State {
+	cb.m.Lock()
+	notify := cb.refresh(time.Now())
+	state := cb.state
+	cb.m.Unlock()
+
+	notify()
+
+	return state
+}
+
+// Wrap は、CircuitBreaker で保護された Circuit を返します。
+func (cb *CircuitBreaker) Wrap(circuit Circuit) Circuit {
+	return untyped(ProtectOf(cb, circuit.typed()))
+}
+
+// ProtectOf は、CircuitBreaker で保護された CircuitOf を返します。
+// 呼び出しが拒否された場合、circuit は実行されず CircuitOpenError か
+// ErrTooManyProbes が返されます。
+func ProtectOf[Req, Resp any](cb *CircuitBreaker, circuit CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+	return func(ctx context.Context, req Req) (Resp, error) {
+		generation, err := cb.allow()
+		if err != nil {
+			var zero Resp
+			return zero, err
+		}
+
+		start := time.Now()
+		response, err := circuit(ctx, req)
+		cb.done(generation, time.Since(start), err)
+
+		return response, err
+	}
+}
+
+// allow は呼び出しを許可するかを判定し、許可した場合は現在の世代を返します。
+func (cb *CircuitBreaker) allow() (uint64, error) {
+	cb.m.Lock()
+	notify := cb.refresh(time.Now())
+
+	var err error
+	switch cb.state {
+	case StateOpen:
+		err = &CircuitOpenError{ReopenAt: cb.openedAt.Add(cb.openFor)}
+	case StateHalfOpen:
+		if cb.probes >= cb.settings.HalfOpenMaxCalls {
+			err = ErrTooManyProbes
+		} else {
+			cb.probes++
+		}
+	}
+
+	generation := cb.generation
+	cb.m.Unlock()
+
+	notify()
+
+	return generation, err
+}
+
+// done は許可された呼び出しの結果と所要時間を記録します。
+// 呼び出し中に状態が変わっていた場合、結果は無視されます。
+func (cb *CircuitBreaker) done(generation uint64, elapsed time.Duration, err error) {
+	cb.m.Lock()
+	now := time.Now()
+	notify := cb.refresh(now)
+
+	result := classify(cb.settings.Classifier, err)
+	failed := result == OutcomeFailure || result == OutcomePermanent
+
+	if result == OutcomeIgnore {
+		// 半開状態の試行枠だけを返却し、結果は記録しない
+		if generation == cb.generation && cb.state == StateHalfOpen {
+			cb.probes--
+		}
+	} else if generation == cb.generation {
+		switch {
+		case cb.state == StateClosed && cb.window != nil:
+			if cb.shouldTrip(now, elapsed, failed) {
+				notify = cb.transition(StateOpen, now)
+			}
+		case cb.state == StateClosed && !failed:
+			cb.failures = 0
+		case cb.state == StateClosed:
+			cb.failures++
+			if cb.failures >= cb.settings.FailureThreshold {
+				notify = cb.transition(StateOpen, now)
+			}
+		case cb.state == StateHalfOpen && !failed:
+			cb.probes--
+			cb.successes++
+			if cb.successes >= cb.settings.SuccessThreshold {
+				notify = cb.transition(StateClosed, now)
+			}
+		case cb.state == StateHalfOpen:
+			notify = cb.transition(StateOpen, now)
+		}
+	}
+
+	cb.m.Unlock()
+
+	notify()
+}
+
+// shouldTrip は呼び出しの結果をウィンドウに記録し、
+// 失敗率か遅い呼び出しの割合が閾値に達していれば true を返します。
+// ロックを保持した状態で呼び出す必要があります。
+func (cb *CircuitBreaker) shouldTrip(now time.Time, elapsed time.Duration, failed bool) bool {
+	slow := cb.settings.SlowCallDuration > 0 && elapsed >= cb.settings.SlowCallDuration
+	counts := cb.window.record(now, outcome{failed: failed, slow: slow})
+
+	if counts.calls < cb.settings.MinimumCalls {
+		return false
+	}
+
+	return counts.failureRate() >= cb.settings.FailureRateThreshold ||
+		(cb.settings.SlowCallDuration > 0 && counts.slowRate() >= cb.settings.SlowCallRateThreshold)
+}
+
+// refresh は、開状態で OpenTimeout が経過していれば半開状態に遷移させます。
+// ロックを保持した状態で呼び出す必要があります。
+func (cb *CircuitBreaker) refresh(now time.Time) func() {
+	if cb.state == StateOpen && !now.Before(cb.openedAt.Add(cb.openFor)) {
+		return cb.transition(StateHalfOpen, now)
+	}
+
+	return func() {}
+}
+
+// transition は状態を遷移させてカウンタをリセットし、OnStateChange を呼び出す関数を返します。
+// 返された関数はロックを解放した後に呼び出す必要があります。
+func (cb *CircuitBreaker) transition(to State, now time.Time) func() {
+	from := cb.state
+	if from == to {
+		return func() {}
+	}
+
+	cb.state = to
+	cb.generation++
+	cb.failures = 0
+	cb.successes = 0
+	cb.probes = 0
+
+	if cb.window != nil {
+		cb.window.reset()
+	}
+
+	switch to {
+	case StateOpen:
+		cb.openedAt = now
+		if cb.settings.OpenBackoff != nil {
+			cb.openFor = cb.settings.OpenBackoff.Next(cb.opens, cb.openFor)
+		} else {
+			cb.openFor = cb.settings.OpenTimeout
+		}
+		cb.opens++
+	case StateClosed:
+		cb.opens = 0
+		cb.openFor = 0
+	}
+
+	onStateChange := cb.settings.OnStateChange
+	name := cb.settings.Name
+
+	return func() {
+		if onStateChange != nil {
+			onStateChange(name, from, to)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestCircuitBreakerStateTransitions tests that the CircuitBreaker moves
+// from closed to open, then to half-open, and closes again after enough
+// successful probes.
+func TestCircuitBreakerStateTransitions(t *testing.T) {
+	var m sync.Mutex
+	var transitions []string
+
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		Name:             "test",
+		FailureThreshold: 2,
+		OpenTimeout:      100 * time.Millisecond,
+		SuccessThreshold: 2,
+		OnStateChange: func(name string, from, to State) {
+			m.Lock()
+			defer m.Unlock()
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	})
+
+	fail := true
+	circuit := cb.Wrap(func(ctx context.Context) (string, error) {
+		if fail {
+			return "", errors.New("INTENTIONAL FAIL!")
+		}
+		return "Success", nil
+	})
+
+	ctx := context.Background()
+
+	circuit(ctx)
+	if cb.State() != StateClosed {
+		t.Error("expected closed after 1 failure; got", cb.State())
+	}
+
+	circuit(ctx)
+	if cb.State() != StateOpen {
+		t.Error("expected open after 2 failures; got", cb.State())
+	}
+
+	if _, err := circuit(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected ErrCircuitOpen; got", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if cb.State() != StateHalfOpen {
+		t.Error("expected half-open after timeout; got", cb.State())
+	}
+
+	fail = false
+
+	circuit(ctx)
+	if cb.State() != StateHalfOpen {
+		t.Error("expected half-open after 1 success; got", cb.State())
+	}
+
+	circuit(ctx)
+	if cb.State() != StateClosed {
+		t.Error("expected closed after 2 successes; got", cb.State())
+	}
+
+	expected := []string{"closed->open", "open->half-open", "half-open->closed"}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if len(transitions) != len(expected) {
+		t.Fatalf("expected transitions %v; got %v", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Errorf("expected transition %s; got %s", expected[i], transitions[i])
+		}
+	}
+}
+
+// TestCircuitBreakerHalfOpenFailure tests that a failed probe reopens the
+// circuit.
+func TestCircuitBreakerHalfOpenFailure(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold: 1,
+		OpenTimeout:      50 * time.Millisecond,
+	})
+
+	circuit := cb.Wrap(failAfter(0))
+	ctx := context.Background()
+
+	circuit(ctx)
+	time.Sleep(75 * time.Millisecond)
+
+	if _, err := circuit(ctx); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected the probe to reach the circuit; got", err)
+	}
+
+	if cb.State() != StateOpen {
+		t.Error("expected open after failed probe; got", cb.State())
+	}
+}
+
+// TestCircuitBreakerHalfOpenMaxCalls tests that only HalfOpenMaxCalls
+// concurrent probes are let through while half-open.
+func TestCircuitBreakerHalfOpenMaxCalls(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold: 1,
+		OpenTimeout:      50 * time.Millisecond,
+		HalfOpenMaxCalls: 2,
+		SuccessThreshold: 5,
+	})
+
+	release := make(chan struct{})
+	circuit := ProtectOf(cb, func(ctx context.Context, fail bool) (int, error) {
+		if fail {
+			return 0, errors.New("INTENTIONAL FAIL!")
+		}
+		<-release
+		return 1, nil
+	})
+
+	ctx := context.Background()
+
+	circuit(ctx, true)
+	time.Sleep(75 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	rejected := 0
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := circuit(ctx, false)
+			if errors.Is(err, ErrTooManyProbes) {
+				m.Lock()
+				rejected++
+				m.Unlock()
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if rejected != 3 {
+		t.Error("expected 3 rejected probes; got", rejected)
+	}
+}
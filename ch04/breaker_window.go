@@ -0,0 +1,161 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import "time"
+
+// timeWindowBuckets は時間ベースのウィンドウを分割するバケットの数です。
+const timeWindowBuckets = 10
+
+// outcome は1回の呼び出しの結果です。
+type outcome struct {
+	failed bool
+	slow   bool
+}
+
+// windowCounts はウィンドウ内の呼び出しの集計です。
+type windowCounts struct {
+	calls    int
+	failures int
+	slow     int
+}
+
+// add は集計に結果を1つ加えます。
+func (c *windowCounts) add(o outcome) {
+	c.calls++
+	if o.failed {
+		c.failures++
+	}
+	if o.slow {
+		c.slow++
+	}
+}
+
+// remove は集計から結果を1つ取り除きます。
+func (c *windowCounts) remove(o outcome) {
+	c.calls--
+	if o.failed {
+		c.failures--
+	}
+	if o.slow {
+		c.slow--
+	}
+}
+
+// failureRate は失敗率をパーセントで返します。
+func (c windowCounts) failureRate() float64 {
+	if c.calls == 0 {
+		return 0
+	}
+	return float64(c.failures) * 100 / float64(c.calls)
+}
+
+// slowRate は遅い呼び出しの割合をパーセントで返します。
+func (c windowCounts) slowRate() float64 {
+	if c.calls == 0 {
+		return 0
+	}
+	return float64(c.slow) * 100 / float64(c.calls)
+}
+
+// slidingWindow は直近の呼び出し結果を集計するウィンドウです。
+type slidingWindow interface {
+	record(now time.Time, o outcome) windowCounts
+	reset()
+}
+
+// countWindow は直近 size 回の呼び出しを集計するウィンドウです。
+type countWindow struct {
+	outcomes []outcome
+	next     int
+	full     bool
+	counts   windowCounts
+}
+
+func newCountWindow(size int) *countWindow {
+	return &countWindow{outcomes: make([]outcome, size)}
+}
+
+func (w *countWindow) record(_ time.Time, o outcome) windowCounts {
+	if w.full {
+		w.counts.remove(w.outcomes[w.next])
+	}
+
+	w.outcomes[w.next] = o
+	w.counts.add(o)
+
+	w.next++
+	if w.next == len(w.outcomes) {
+		w.next = 0
+		w.full = true
+	}
+
+	return w.counts
+}
+
+func (w *countWindow) reset() {
+	clear(w.outcomes)
+	w.next = 0
+	w.full = false
+	w.counts = windowCounts{}
+}
+
+// timeBucket は時間ベースのウィンドウの1区間分の集計です。
+type timeBucket struct {
+	epoch  int64 // このバケットが表す区間の番号
+	counts windowCounts
+}
+
+// timeWindow は直近 duration の間の呼び出しを集計するウィンドウです。
+// ウィンドウは timeWindowBuckets 個のバケットに分割され、古いバケットから順に破棄されます。
+type timeWindow struct {
+	width   time.Duration
+	buckets [timeWindowBuckets]timeBucket
+}
+
+func newTimeWindow(duration time.Duration) *timeWindow {
+	width := duration / timeWindowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &timeWindow{width: width}
+}
+
+func (w *timeWindow) record(now time.Time, o outcome) windowCounts {
+	epoch := now.UnixNano() / int64(w.width)
+
+	b := &w.buckets[epoch%timeWindowBuckets]
+	if b.epoch != epoch {
+		*b = timeBucket{epoch: epoch}
+	}
+	b.counts.add(o)
+
+	var total windowCounts
+	for _, b := range w.buckets {
+		if epoch-b.epoch < timeWindowBuckets {
+			total.calls += b.counts.calls
+			total.failures += b.counts.failures
+			total.slow += b.counts.slow
+		}
+	}
+
+	return total
+}
+
+func (w *timeWindow) reset() {
+	w.buckets = [timeWindowBuckets]timeBucket{}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCountWindow tests that the count-based window only aggregates the most
+// recent calls.
+func TestCountWindow(t *testing.T) {
+	w := newCountWindow(3)
+	now := time.Now()
+
+	w.record(now, outcome{failed: true})
+	w.record(now, outcome{failed: true})
+	w.record(now, outcome{})
+	counts := w.record(now, outcome{slow: true})
+
+	if counts.calls != 3 || counts.failures != 1 || counts.slow != 1 {
+		t.Errorf("unexpected counts: %+v", counts)
+	}
+}
+
+// TestTimeWindow tests that the time-based window drops calls older than
+// its duration.
+func TestTimeWindow(t *testing.T) {
+	w := newTimeWindow(time.Second)
+	now := time.Now()
+
+	w.record(now, outcome{failed: true})
+	w.record(now.Add(500*time.Millisecond), outcome{failed: true})
+	counts := w.record(now.Add(1200*time.Millisecond), outcome{})
+
+	if counts.calls != 2 || counts.failures != 1 {
+		t.Errorf("unexpected counts: %+v", counts)
+	}
+}
+
+// TestCircuitBreakerFailureRate tests that interleaved failures trip the
+// circuit once the failure rate reaches the threshold, even though there are
+// never two consecutive failures.
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold:     2,
+		WindowSize:           10,
+		FailureRateThreshold: 50,
+	})
+
+	circuit := ProtectOf(cb, func(ctx context.Context, fail bool) (string, error) {
+		if fail {
+			return "", errors.New("INTENTIONAL FAIL!")
+		}
+		return "Success", nil
+	})
+
+	ctx := context.Background()
+
+	// 60% failure rate, interleaved with successes.
+	pattern := []bool{true, false, true, false, true, true, false, true, false, true}
+
+	for i, fail := range pattern {
+		if cb.State() != StateClosed {
+			t.Fatalf("circuit opened early, after %d calls", i)
+		}
+		circuit(ctx, fail)
+	}
+
+	if cb.State() != StateOpen {
+		t.Error("expected open; got", cb.State())
+	}
+}
+
+// TestCircuitBreakerMinimumCalls tests that a single early failure doesn't
+// trip the circuit before MinimumCalls calls have been made.
+func TestCircuitBreakerMinimumCalls(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		WindowDuration: time.Minute,
+		MinimumCalls:   5,
+	})
+
+	circuit := cb.Wrap(failAfter(0))
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		circuit(ctx)
+	}
+
+	if cb.State() != StateClosed {
+		t.Error("expected closed before MinimumCalls; got", cb.State())
+	}
+
+	circuit(ctx)
+
+	if cb.State() != StateOpen {
+		t.Error("expected open after MinimumCalls; got", cb.State())
+	}
+}
+
+// TestCircuitBreakerSlowCallRate tests that successful but slow calls trip
+// the circuit.
+func TestCircuitBreakerSlowCallRate(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		WindowSize:            4,
+		SlowCallDuration:      10 * time.Millisecond,
+		SlowCallRateThreshold: 50,
+	})
+
+	circuit := ProtectOf(cb, func(ctx context.Context, d time.Duration) (string, error) {
+		time.Sleep(d)
+		return "Success", nil
+	})
+
+	ctx := context.Background()
+
+	circuit(ctx, 0)
+	circuit(ctx, 20*time.Millisecond)
+	circuit(ctx, 0)
+
+	if cb.State() != StateClosed {
+		t.Error("expected closed; got", cb.State())
+	}
+
+	circuit(ctx, 20*time.Millisecond)
+
+	if cb.State() != StateOpen {
+		t.Error("expected open; got", cb.State())
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BulkheadSettings は Bulkhead の設定です。
+type BulkheadSettings struct {
+	// MaxConcurrent は同時に実行できる呼び出しの数です。既定値は 10 です。
+	MaxConcurrent int
+
+	// MaxQueue は、実行できる枠が空くのを待つことができる呼び出しの数です。
+	// 0 の場合は待たずに拒否します。
+	MaxQueue int
+
+	// MaxWait は、待ち行列で待つ時間の上限です。0 の場合はコンテキストが終了するまで待ちます。
+	MaxWait time.Duration
+}
+
+// BulkheadStats は Bulkhead の現在の状態です。
+type BulkheadStats struct {
+	InFlight int    // 実行中の呼び出しの数
+	Queued   int    // 待ち行列で待っている呼び出しの数
+	Rejected uint64 // これまでに拒否した呼び出しの数
+}
+
+// Bulkhead は、依存先ごとに同時実行数と待ち行列の長さを制限し、
+// 1つの遅い依存先が全てのゴルーチンを使い果たすことを防ぎます。
+type Bulkhead struct {
+	settings BulkheadSettings
+	slots    chan struct{}
+
+	m        sync.Mutex
+	queued   int
+	rejected uint64
+}
+
+// NewBulkhead は、指定された設定で Bulkhead を作成します。
+func NewBulkhead(settings BulkheadSettings) *Bulkhead {
+	if settings.MaxConcurrent <= 0 {
+		settings.MaxConcurrent = 10
+	}
+
+	return &Bulkhead{
+		settings: settings,
+		slots:    make(chan struct{}, settings.MaxConcurrent),
+	}
+}
+
+// Stats は現在の状態を返します。
+func (b *Bulkhead) Stats() BulkheadStats {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return BulkheadStats{
+		InFlight: len(b.slots),
+		Queued:   b.queued,
+		Rejected: b.rejected,
+	}
+}
+
+// Wrap は、Bulkhead で同時実行数を制限した Effector を返します。
+func (b *Bulkhead) Wrap(e Effector) Effector {
+	return Effector(untyped(BulkheadOf(b, e.typed())))
+}
+
+// BulkheadOf は、Bulkhead で同時実行数を制限した CircuitOf を返します。
+// 枠が空かず待ち行列にも入れない場合や MaxWait を過ぎた場合は ErrBulkheadFull を、
+// 待機中にコンテキストが終了した場合はコンテキストのエラーを返します。
+func BulkheadOf[Req, Resp any](b *Bulkhead, e CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+	return func(ctx context.Context, req Req) (Resp, error) {
+		if err := b.acquire(ctx); err != nil {
+			var zero Resp
+			return zero, err
+		}
+		defer b.release()
+
+		return e(ctx, req)
+	}
+}
+
+// acquire は実行の枠を1つ確保します。
+func (b *Bulkhead) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	b.m.Lock()
+	if b.queued >= b.settings.MaxQueue {
+		b.rejected++
+		b.m.Unlock()
+		return ErrBulkheadFull
+	}
+	b.queued++
+	b.m.Unlock()
+
+	defer func() {
+		b.m.Lock()
+		b.queued--
+		b.m.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if b.settings.MaxWait > 0 {
+		timer := time.NewTimer(b.settings.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		b.m.Lock()
+		b.rejected++
+		b.m.Unlock()
+		return ErrBulkheadFull
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release は実行の枠を返却します。
+func (b *Bulkhead) release() {
+	<-b.slots
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingEffector returns an Effector that blocks until release is closed.
+func blockingEffector(release <-chan struct{}) Effector {
+	return func(ctx context.Context) (string, error) {
+		<-release
+		return "done", nil
+	}
+}
+
+// TestBulkheadRejectsWithoutQueue tests that calls beyond MaxConcurrent are
+// rejected immediately when there's no queue.
+func TestBulkheadRejectsWithoutQueue(t *testing.T) {
+	b := NewBulkhead(BulkheadSettings{MaxConcurrent: 2})
+	release := make(chan struct{})
+	bulkhead := b.Wrap(blockingEffector(release))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bulkhead(context.Background())
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := bulkhead(context.Background()); !errors.Is(err, ErrBulkheadFull) {
+		t.Error("expected ErrBulkheadFull; got", err)
+	}
+
+	stats := b.Stats()
+	if stats.InFlight != 2 || stats.Queued != 0 || stats.Rejected != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+// TestBulkheadQueue tests that queued calls run once a slot frees up, that
+// the queue is bounded, and that MaxWait is enforced.
+func TestBulkheadQueue(t *testing.T) {
+	b := NewBulkhead(BulkheadSettings{MaxConcurrent: 1, MaxQueue: 1, MaxWait: 100 * time.Millisecond})
+	release := make(chan struct{})
+	bulkhead := b.Wrap(blockingEffector(release))
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := bulkhead(context.Background())
+			results <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats := b.Stats(); stats.InFlight != 1 || stats.Queued != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if _, err := bulkhead(context.Background()); !errors.Is(err, ErrBulkheadFull) {
+		t.Error("expected ErrBulkheadFull with a full queue; got", err)
+	}
+
+	// The queued call gives up after MaxWait.
+	if err := <-results; !errors.Is(err, ErrBulkheadFull) {
+		t.Error("expected the queued call to time out; got", err)
+	}
+
+	close(release)
+	if err := <-results; err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if stats := b.Stats(); stats.Rejected != 2 {
+		t.Error("expected 2 rejections; got", stats.Rejected)
+	}
+}
+
+// TestBulkheadContextCancel tests that a queued call returns the context
+// error when cancelled.
+func TestBulkheadContextCancel(t *testing.T) {
+	b := NewBulkhead(BulkheadSettings{MaxConcurrent: 1, MaxQueue: 1})
+	release := make(chan struct{})
+	defer close(release)
+
+	bulkhead := BulkheadOf(b, func(ctx context.Context, _ int) (string, error) {
+		<-release
+		return "done", nil
+	})
+
+	go bulkhead(context.Background(), 1)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := bulkhead(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected context.DeadlineExceeded; got", err)
+	}
+}
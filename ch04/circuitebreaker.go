@@ -18,7 +18,6 @@ package ch04
 
 import (
 	"context"
-	"errors"
 	"sync"
 	"time"
 )
@@ -27,44 +26,101 @@ import (
 // 非同期処理やリトライ、スロットリングなどの機構で使用されます。
 type Circuit func(context.Context) (string, error)
 
+// CircuitOf は、コンテキストと Req 型のリクエストを受け取り、Resp 型のレスポンスと
+// エラーを返す関数型です。Circuit や Effector の型パラメータ版です。
+type CircuitOf[Req, Resp any] func(context.Context, Req) (Resp, error)
+
+// typed は Circuit を引数を取らない CircuitOf に変換します。
+func (c Circuit) typed() CircuitOf[struct{}, string] {
+	return func(ctx context.Context, _ struct{}) (string, error) {
+		return c(ctx)
+	}
+}
+
+// untyped は引数を取らない CircuitOf を Circuit に変換します。
+func untyped(c CircuitOf[struct{}, string]) Circuit {
+	return func(ctx context.Context) (string, error) {
+		return c(ctx, struct{}{})
+	}
+}
+
 // Breaker は、指定された回数の失敗後、指定された時間後に再試行する機能を持つラッパーを返します。
 // threshold は、失敗回数の閾値を指定します。
 // コンテキストの終了シグナルを監視し、キャンセル時に即時終了します。
 // Effector が成功した場合、すぐに結果を返し、失敗した場合はリトライを続けます。
 func Breaker(circuit Circuit, threshold int) Circuit {
+	return untyped(BreakerOf(circuit.typed(), threshold))
+}
+
+// BreakerOptions は BreakerWith の設定です。
+type BreakerOptions struct {
+	// Threshold は、回路を開く失敗回数の閾値です。
+	Threshold int
+
+	// Classifier はエラーを失敗として数えるかどうか分類します。
+	// nil の場合は DefaultClassifier を使います。
+	Classifier Classifier
+
+	// Backoff は、回路が開いてから再試行を許可するまでの待機時間を決めます。
+	// attempt には閾値を超えた失敗の回数 (0 始まり) が渡されます。
+	// nil の場合は 2 秒から倍々に増やします。
+	Backoff Backoff
+}
+
+// BreakerOf は Breaker の型パラメータ版です。
+// 回路が開いている間はゼロ値の Resp と CircuitOpenError を返します。
+func BreakerOf[Req, Resp any](circuit CircuitOf[Req, Resp], threshold int) CircuitOf[Req, Resp] {
+	return BreakerWith(circuit, BreakerOptions{Threshold: threshold})
+}
+
+// BreakerWith は、opts に従って circuit を保護するラッパーを返します。
+// Classifier が OutcomeIgnore と分類したエラーは失敗回数に影響しません。
+func BreakerWith[Req, Resp any](circuit CircuitOf[Req, Resp], opts BreakerOptions) CircuitOf[Req, Resp] {
+	backoff := opts.Backoff
+	if backoff == nil {
+		backoff = defaultBreakerBackoff
+	}
+
 	var failures int
 	var last = time.Now()
+	var delay time.Duration
 	var m sync.RWMutex
 
-	return func(ctx context.Context) (string, error) {
+	return func(ctx context.Context, req Req) (Resp, error) {
 		m.RLock() // Establish a "read lock"
 
-		d := failures - threshold
+		d := failures - opts.Threshold
 
 		if d >= 0 {
-			shouldRetryAt := last.Add((2 << d) * time.Second)
+			shouldRetryAt := last.Add(delay)
 			if !time.Now().After(shouldRetryAt) {
 				m.RUnlock()
-				return "", errors.New("service unreachable")
+				var zero Resp
+				return zero, &CircuitOpenError{ReopenAt: shouldRetryAt}
 			}
 		}
 
 		m.RUnlock() // Release read lock
 
-		response, err := circuit(ctx) // Issue the request proper
+		response, err := circuit(ctx, req) // Issue the request proper
 
 		m.Lock() // Lock around shared resources
 		defer m.Unlock()
 
 		last = time.Now() // Record time of attempt
 
-		if err != nil { // Circuit returned an error,
-			failures++           // so we count the failure
-			return response, err // and return
-		}
+		switch classify(opts.Classifier, err) {
+		case OutcomeFailure, OutcomePermanent:
+			failures++ // Count the failure
 
-		failures = 0 // Reset failures counter
+			if d := failures - opts.Threshold; d >= 0 {
+				delay = backoff.Next(d, delay) // Compute the reopen delay once per failure
+			}
+		case OutcomeSuccess:
+			failures = 0 // Reset failures counter
+			delay = 0
+		}
 
-		return response, nil
+		return response, err
 	}
 }
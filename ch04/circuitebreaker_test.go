@@ -169,3 +169,36 @@ func TestCircuitBreakerDataRace(t *testing.T) {
 
 	wg.Wait()
 }
+
+// TestBreakerOf tests that the generic BreakerOf passes typed requests and
+// responses through, and opens after the threshold is exceeded.
+func TestBreakerOf(t *testing.T) {
+	type request struct{ ID int }
+	type response struct{ Doubled int }
+
+	circuit := func(ctx context.Context, req request) (response, error) {
+		if req.ID < 0 {
+			return response{}, errors.New("INTENTIONAL FAIL!")
+		}
+		return response{Doubled: req.ID * 2}, nil
+	}
+
+	breaker := BreakerOf(circuit, 1)
+	ctx := context.Background()
+
+	res, err := breaker(ctx, request{ID: 21})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if res.Doubled != 42 {
+		t.Error("expected 42; got", res.Doubled)
+	}
+
+	breaker(ctx, request{ID: -1})
+	breaker(ctx, request{ID: -1})
+
+	_, err = breaker(ctx, request{ID: 1})
+	if err == nil || !strings.HasPrefix(err.Error(), "service unreachable") {
+		t.Error("expected circuit to be open; got", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import "errors"
+
+// Outcome は、呼び出しの結果をブレーカーやリトライがどう扱うかを表します。
+type Outcome int
+
+const (
+	// OutcomeSuccess は成功として扱います。ブレーカーの失敗回数はリセットされ、リトライは行われません。
+	OutcomeSuccess Outcome = iota
+
+	// OutcomeFailure は失敗として扱います。ブレーカーは失敗を数え、リトライは再試行します。
+	OutcomeFailure
+
+	// OutcomeIgnore は成功とも失敗とも扱いません。ブレーカーは何も記録せず、リトライは再試行しません。
+	OutcomeIgnore
+
+	// OutcomePermanent は再試行しても回復しない失敗として扱います。
+	// ブレーカーは失敗を数え、リトライは直ちに終了します。
+	OutcomePermanent
+)
+
+// String は Outcome の名前を返します。
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeFailure:
+		return "failure"
+	case OutcomeIgnore:
+		return "ignore"
+	case OutcomePermanent:
+		return "permanent"
+	default:
+		return "unknown"
+	}
+}
+
+// Classifier は、呼び出しが返したエラーを Outcome に分類する関数型です。
+// err が nil の場合にも呼び出されます。
+type Classifier func(err error) Outcome
+
+// DefaultClassifier は、nil を成功、Permanent で包まれたエラーを恒久的な失敗、
+// それ以外のエラーを失敗に分類します。
+func DefaultClassifier(err error) Outcome {
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case IsPermanent(err):
+		return OutcomePermanent
+	default:
+		return OutcomeFailure
+	}
+}
+
+// classify は classifier で err を分類します。classifier が nil の場合は DefaultClassifier を使います。
+func classify(classifier Classifier, err error) Outcome {
+	if classifier == nil {
+		return DefaultClassifier(err)
+	}
+	return classifier(err)
+}
+
+// PermanentError は、リトライしても回復しないエラーを表します。
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent は err を PermanentError で包みます。
+// Retry は Permanent で包まれたエラーを受け取ると、リトライせずに元のエラーを返します。
+// err が nil の場合は nil を返します。
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent は err が Permanent で包まれているかを返します。
+func IsPermanent(err error) bool {
+	var perr *PermanentError
+	return errors.As(err, &perr)
+}
+
+// unwrapPermanent は、err 自体が PermanentError であれば、その層だけを取り除いたエラーを返します。
+// PermanentError がさらに別のエラーで包まれている場合は、外側の文脈を失わないように err をそのまま返します。
+// PermanentError のメッセージは元のエラーと同じなので、どちらの場合もメッセージは変わりません。
+func unwrapPermanent(err error) error {
+	if perr, ok := err.(*PermanentError); ok {
+		return perr.Err
+	}
+	return err
+}
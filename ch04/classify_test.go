@@ -0,0 +1,155 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+
+// notFoundIsSuccess classifies errNotFound as a success and everything else
+// with DefaultClassifier.
+func notFoundIsSuccess(err error) Outcome {
+	if errors.Is(err, errNotFound) {
+		return OutcomeSuccess
+	}
+	return DefaultClassifier(err)
+}
+
+// TestDefaultClassifier tests the classification of nil, plain and
+// permanent errors.
+func TestDefaultClassifier(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Outcome
+	}{
+		{nil, OutcomeSuccess},
+		{errNotFound, OutcomeFailure},
+		{Permanent(errNotFound), OutcomePermanent},
+		{fmt.Errorf("wrapped: %w", Permanent(errNotFound)), OutcomePermanent},
+	}
+
+	for _, tt := range tests {
+		if got := DefaultClassifier(tt.err); got != tt.want {
+			t.Errorf("DefaultClassifier(%v): expected %v; got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+// TestRetryPermanent tests that Retry stops immediately on a Permanent
+// error and returns the unwrapped error.
+func TestRetryPermanent(t *testing.T) {
+	attempts := 0
+	r := Retry(func(ctx context.Context) (string, error) {
+		attempts++
+		return "", Permanent(errNotFound)
+	}, 5, time.Second)
+
+	_, err := r(context.Background())
+
+	if attempts != 1 {
+		t.Error("expected 1 attempt; got", attempts)
+	}
+	if err != errNotFound {
+		t.Error("expected errNotFound; got", err)
+	}
+}
+
+// TestRetryPermanentKeepsContext tests that wrappers around a Permanent
+// error are preserved.
+func TestRetryPermanentKeepsContext(t *testing.T) {
+	r := Retry(func(ctx context.Context) (string, error) {
+		return "", fmt.Errorf("get key foo: %w", Permanent(errNotFound))
+	}, 5, time.Second)
+
+	_, err := r(context.Background())
+
+	if err == nil || err.Error() != "get key foo: "+errNotFound.Error() {
+		t.Error("expected the wrapped message; got", err)
+	}
+	if !errors.Is(err, errNotFound) {
+		t.Error("expected errors.Is to find errNotFound; got", err)
+	}
+}
+
+// TestRetryWithClassifier tests that errors classified as non-failures
+// aren't retried.
+func TestRetryWithClassifier(t *testing.T) {
+	attempts := 0
+	r := RetryWith(func(ctx context.Context, key string) (string, error) {
+		attempts++
+		return "", errNotFound
+	}, RetryOptions{Retries: 5, Delay: time.Second, Classifier: notFoundIsSuccess})
+
+	_, err := r(context.Background(), "missing")
+
+	if attempts != 1 {
+		t.Error("expected 1 attempt; got", attempts)
+	}
+	if !errors.Is(err, errNotFound) {
+		t.Error("expected errNotFound; got", err)
+	}
+}
+
+// TestBreakerWithClassifier tests that errors classified as successes or
+// ignored don't trip the breaker.
+func TestBreakerWithClassifier(t *testing.T) {
+	classifier := func(err error) Outcome {
+		if errors.Is(err, errNotFound) {
+			return OutcomeIgnore
+		}
+		return DefaultClassifier(err)
+	}
+
+	breaker := BreakerWith(func(ctx context.Context, key string) (string, error) {
+		return "", errNotFound
+	}, BreakerOptions{Threshold: 1, Classifier: classifier})
+
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := breaker(ctx, "missing"); !errors.Is(err, errNotFound) {
+			t.Fatal("expected errNotFound; got", err)
+		}
+	}
+}
+
+// TestCircuitBreakerClassifier tests that the CircuitBreaker doesn't count
+// errors classified as successes.
+func TestCircuitBreakerClassifier(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{
+		FailureThreshold: 1,
+		Classifier:       notFoundIsSuccess,
+	})
+
+	circuit := cb.Wrap(func(ctx context.Context) (string, error) {
+		return "", errNotFound
+	})
+
+	for i := 0; i < 5; i++ {
+		circuit(context.Background())
+	}
+
+	if cb.State() != StateClosed {
+		t.Error("expected closed; got", cb.State())
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDebounceCancelled は、待機中の呼び出しが Debouncer.Cancel で取り消されたことを表すエラーです。
+var ErrDebounceCancelled = errors.New("debounced call cancelled")
+
+// DebounceMode は、連続した呼び出しのどこで circuit を実行するかを表します。
+type DebounceMode int
+
+const (
+	// DebounceTrailing は、呼び出しが Wait の間途切れたときに、最後の呼び出しのリクエストで実行します。
+	DebounceTrailing DebounceMode = iota
+
+	// DebounceLeading は、連続した呼び出しの最初の呼び出しで直ちに実行し、
+	// 続く呼び出しにはその結果を返します。
+	DebounceLeading
+
+	// DebounceBoth は、最初の呼び出しで直ちに実行し、その後に呼び出しがあれば
+	// 途切れたときにも最後の呼び出しのリクエストで実行します。
+	DebounceBoth
+)
+
+// String は DebounceMode の名前を返します。
+func (m DebounceMode) String() string {
+	switch m {
+	case DebounceTrailing:
+		return "trailing"
+	case DebounceLeading:
+		return "leading"
+	case DebounceBoth:
+		return "both"
+	default:
+		return "unknown"
+	}
+}
+
+// DebounceSettings は Debouncer の設定です。
+type DebounceSettings struct {
+	// Mode は circuit を実行する位置です。既定は DebounceTrailing です。
+	Mode DebounceMode
+
+	// Wait は、呼び出しが途切れたとみなすまでの時間です。
+	Wait time.Duration
+
+	// MaxWait は、呼び出しが途切れなくても circuit を実行するまでの最長の時間です。
+	// 0 の場合は制限しません。
+	MaxWait time.Duration
+}
+
+// debounceCall は、circuit の1回の実行とその結果を待つ呼び出しを表します。
+type debounceCall[Req, Resp any] struct {
+	ctx      context.Context
+	req      Req
+	done     chan struct{}
+	response Resp
+	err      error
+}
+
+// wait は呼び出しの結果か、ctx の終了を待ちます。
+func (c *debounceCall[Req, Resp]) wait(ctx context.Context) (Resp, error) {
+	select {
+	case <-c.done:
+		return c.response, c.err
+	case <-ctx.Done():
+		var zero Resp
+		return zero, ctx.Err()
+	}
+}
+
+// Debouncer は、連続した呼び出しをまとめて circuit を実行します。
+// DebounceFirst と DebounceLast の機能を1つの設定で扱えるようにしたものです。
+type Debouncer[Req, Resp any] struct {
+	circuit  CircuitOf[Req, Resp]
+	settings DebounceSettings
+
+	m          sync.Mutex
+	generation uint64 // 古いタイマーを無視するため、連続した呼び出しごとに増やす
+	timer      *time.Timer
+	active     bool      // 連続した呼び出しの途中であるか
+	lastCall   time.Time // 最後の呼び出しの時刻
+	lastRun    time.Time // MaxWait を数え始めた時刻
+	leading    *debounceCall[Req, Resp]
+	pending    *debounceCall[Req, Resp]
+}
+
+// Debounce は、circuit への連続した呼び出しを settings に従ってまとめる Debouncer を返します。
+func Debounce(circuit Circuit, settings DebounceSettings) *Debouncer[struct{}, string] {
+	return DebounceOf(circuit.typed(), settings)
+}
+
+// DebounceOf は Debounce の型パラメータ版です。
+func DebounceOf[Req, Resp any](circuit CircuitOf[Req, Resp], settings DebounceSettings) *Debouncer[Req, Resp] {
+	return &Debouncer[Req, Resp]{circuit: circuit, settings: settings}
+}
+
+// Call は circuit を呼び出します。DebounceTrailing と DebounceBoth では、
+// まとめられた呼び出しは最後の呼び出しのリクエストによる実行の結果を共有します。
+// 結果を待っている間に ctx が終了した場合は ctx.Err() を返しますが、共有している実行は取り消されません。
+func (d *Debouncer[Req, Resp]) Call(ctx context.Context, req Req) (Resp, error) {
+	d.m.Lock()
+	now := time.Now()
+	d.lastCall = now
+
+	if !d.active {
+		d.active = true
+		d.generation++
+		d.lastRun = now
+		d.schedule(d.settings.Wait)
+
+		if d.settings.Mode != DebounceTrailing {
+			return d.runLeading(ctx, req)
+		}
+	} else if d.settings.Mode == DebounceLeading {
+		if d.settings.MaxWait > 0 && now.Sub(d.lastRun) >= d.settings.MaxWait {
+			d.lastRun = now
+			return d.runLeading(ctx, req)
+		}
+
+		c := d.leading
+		d.m.Unlock()
+		return c.wait(ctx)
+	}
+
+	if d.pending == nil {
+		d.pending = &debounceCall[Req, Resp]{done: make(chan struct{})}
+	}
+	d.pending.ctx, d.pending.req = ctx, req
+	c := d.pending
+	d.m.Unlock()
+
+	return c.wait(ctx)
+}
+
+// runLeading は req で直ちに circuit の実行を開始し、その結果を待ちます。
+// 続く呼び出しも同じ結果を待てます。ctx が終了した場合は実行を取り消さずに ctx.Err() を返します。
+// ロックを保持した状態で呼び出す必要があり、ロックは解放されます。
+func (d *Debouncer[Req, Resp]) runLeading(ctx context.Context, req Req) (Resp, error) {
+	c := &debounceCall[Req, Resp]{ctx: ctx, req: req, done: make(chan struct{})}
+	d.leading = c
+	d.m.Unlock()
+
+	go d.run(c)
+
+	return c.wait(ctx)
+}
+
+// run は c のリクエストで circuit を実行し、結果を待っている呼び出しに知らせます。
+func (d *Debouncer[Req, Resp]) run(c *debounceCall[Req, Resp]) {
+	c.response, c.err = d.circuit(context.WithoutCancel(c.ctx), c.req)
+	close(c.done)
+}
+
+// schedule は after 後に fire を呼び出すタイマーを設定します。
+// ロックを保持した状態で呼び出す必要があります。
+func (d *Debouncer[Req, Resp]) schedule(after time.Duration) {
+	generation := d.generation
+	d.timer = time.AfterFunc(after, func() {
+		d.fire(generation)
+	})
+}
+
+// deadline は、次に circuit を実行するか連続した呼び出しを終える時刻と、
+// それが MaxWait によるものかを返します。ロックを保持した状態で呼び出す必要があります。
+func (d *Debouncer[Req, Resp]) deadline() (time.Time, bool) {
+	at := d.lastCall.Add(d.settings.Wait)
+
+	if d.settings.MaxWait > 0 && d.settings.Mode != DebounceLeading {
+		if limit := d.lastRun.Add(d.settings.MaxWait); limit.Before(at) {
+			return limit, true
+		}
+	}
+
+	return at, false
+}
+
+// fire はタイマーから呼び出され、期限に達していれば待機中の呼び出しを実行します。
+func (d *Debouncer[Req, Resp]) fire(generation uint64) {
+	d.m.Lock()
+
+	if generation != d.generation || !d.active {
+		d.m.Unlock()
+		return
+	}
+
+	now := time.Now()
+	at, maxWait := d.deadline()
+	if now.Before(at) {
+		d.schedule(at.Sub(now))
+		d.m.Unlock()
+		return
+	}
+
+	c := d.pending
+	d.pending = nil
+
+	if maxWait {
+		// 呼び出しは続いているので、実行した時刻から MaxWait を数え直す
+		d.lastRun = now
+		at, _ = d.deadline()
+		d.schedule(at.Sub(now))
+	} else {
+		d.end()
+	}
+
+	d.m.Unlock()
+
+	if c != nil {
+		d.run(c)
+	}
+}
+
+// end は連続した呼び出しを終えます。ロックを保持した状態で呼び出す必要があります。
+func (d *Debouncer[Req, Resp]) end() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.generation++
+	d.active = false
+	d.leading = nil
+}
+
+// Flush は、待機中の呼び出しがあれば直ちに circuit を実行し、その完了を待ちます。
+// 連続した呼び出しは終了し、次の呼び出しは新たな連続の最初の呼び出しとして扱われます。
+func (d *Debouncer[Req, Resp]) Flush() {
+	d.m.Lock()
+	c := d.pending
+	d.pending = nil
+	d.end()
+	d.m.Unlock()
+
+	if c != nil {
+		d.run(c)
+	}
+}
+
+// Cancel は、待機中の呼び出しを実行せずに取り消します。
+// 結果を待っていた呼び出しには ErrDebounceCancelled が返されます。
+func (d *Debouncer[Req, Resp]) Cancel() {
+	d.m.Lock()
+	c := d.pending
+	d.pending = nil
+	d.end()
+	d.m.Unlock()
+
+	if c != nil {
+		c.err = ErrDebounceCancelled
+		close(c.done)
+	}
+}
@@ -26,12 +26,18 @@ import (
 // 非同期処理やリトライ、スロットリングなどの機構で使用されます。
 // 最初の呼び出しか処理しないようにします。
 func DebounceFirst(circuit Circuit, d time.Duration) Circuit {
+	return untyped(DebounceFirstOf(circuit.typed(), d))
+}
+
+// DebounceFirstOf は DebounceFirst の型パラメータ版です。
+// 期間 d の間はリクエストの内容にかかわらず、最初の呼び出しの結果を返します。
+func DebounceFirstOf[Req, Resp any](circuit CircuitOf[Req, Resp], d time.Duration) CircuitOf[Req, Resp] {
 	var threshold time.Time
-	var result string
+	var result Resp
 	var err error
 	var m sync.Mutex
 
-	return func(ctx context.Context) (string, error) {
+	return func(ctx context.Context, req Req) (Resp, error) {
 		m.Lock()
 		defer m.Unlock()
 
@@ -39,7 +45,7 @@ func DebounceFirst(circuit Circuit, d time.Duration) Circuit {
 			return result, err
 		}
 
-		result, err = circuit(ctx)
+		result, err = circuit(ctx, req)
 		threshold = time.Now().Add(d)
 
 		return result, err
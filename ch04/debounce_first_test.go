@@ -64,3 +64,30 @@ func TestDebounceFirstDataRace(t *testing.T) {
 
 	wg.Wait()
 }
+
+// TestDebounceFirstOf tests that DebounceFirstOf returns the cached typed
+// result for calls made within the debounce window.
+func TestDebounceFirstOf(t *testing.T) {
+	calls := 0
+	circuit := func(ctx context.Context, n int) (int, error) {
+		calls++
+		return n * 10, nil
+	}
+
+	debounce := DebounceFirstOf(circuit, time.Second)
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		res, err := debounce(ctx, i)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if res != 10 {
+			t.Error("expected cached result 10; got", res)
+		}
+	}
+
+	if calls != 1 {
+		t.Error("expected 1 call; got", calls)
+	}
+}
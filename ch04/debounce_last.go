@@ -26,12 +26,23 @@ import (
 // 非同期処理やリトライ、スロットリングなどの機構で使用されます。
 // 最後の呼び出しか処理しないようにします。
 func DebounceLast(circuit Circuit, d time.Duration) Circuit {
+	return untyped(DebounceLastOf(circuit.typed(), d))
+}
+
+// DebounceLastOf は DebounceLast の型パラメータ版です。
+// 期間 d の間に呼び出しが続いた場合、最後の呼び出しのリクエストだけが処理されます。
+func DebounceLastOf[Req, Resp any](circuit CircuitOf[Req, Resp], d time.Duration) CircuitOf[Req, Resp] {
+	type result struct {
+		response Resp
+		err      error
+	}
+
 	var m sync.Mutex
 	var timer *time.Timer
 	var cctx context.Context
 	var cancel context.CancelFunc
 
-	return func(ctx context.Context) (string, error) {
+	return func(ctx context.Context, req Req) (Resp, error) {
 		m.Lock()
 
 		if timer != nil {
@@ -40,26 +51,21 @@ func DebounceLast(circuit Circuit, d time.Duration) Circuit {
 		}
 
 		cctx, cancel = context.WithCancel(ctx)
-		ch := make(chan struct {
-			result string
-			err    error
-		}, 1)
+		ch := make(chan result, 1)
 
 		timer = time.AfterFunc(d, func() {
-			r, e := circuit(cctx)
-			ch <- struct {
-				result string
-				err    error
-			}{r, e}
+			r, e := circuit(cctx, req)
+			ch <- result{r, e}
 		})
 
 		m.Unlock()
 
 		select {
 		case res := <-ch:
-			return res.result, res.err
+			return res.response, res.err
 		case <-cctx.Done():
-			return "", cctx.Err()
+			var zero Resp
+			return zero, cctx.Err()
 		}
 	}
 }
@@ -59,3 +59,21 @@ func TestDebounceLastDataRace(t *testing.T) {
 
 	wg.Wait()
 }
+
+// TestDebounceLastOf tests that DebounceLastOf passes the typed request
+// through once the debounce duration has elapsed.
+func TestDebounceLastOf(t *testing.T) {
+	circuit := func(ctx context.Context, s []string) (int, error) {
+		return len(s), nil
+	}
+
+	debounce := DebounceLastOf(circuit, 50*time.Millisecond)
+
+	res, err := debounce(context.Background(), []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if res != 3 {
+		t.Error("expected 3; got", res)
+	}
+}
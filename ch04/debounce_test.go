@@ -0,0 +1,230 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingCircuit returns a circuit that records each request it runs.
+func recordingCircuit() (CircuitOf[int, int], func() []int) {
+	var m sync.Mutex
+	var runs []int
+
+	circuit := func(ctx context.Context, n int) (int, error) {
+		m.Lock()
+		defer m.Unlock()
+		runs = append(runs, n)
+		return n, nil
+	}
+
+	return circuit, func() []int {
+		m.Lock()
+		defer m.Unlock()
+		return append([]int(nil), runs...)
+	}
+}
+
+// callConcurrently calls d with 1..n, 5ms apart, and returns the results.
+func callConcurrently(d *Debouncer[int, int], n int) []int {
+	results := make([]int, n)
+	wg := sync.WaitGroup{}
+
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i-1], _ = d.Call(context.Background(), i)
+		}(i)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// TestDebounceTrailing tests that a burst runs once with the last request
+// and that every caller shares the result.
+func TestDebounceTrailing(t *testing.T) {
+	circuit, runs := recordingCircuit()
+	d := DebounceOf(circuit, DebounceSettings{Wait: 30 * time.Millisecond})
+
+	results := callConcurrently(d, 5)
+
+	if got := runs(); len(got) != 1 || got[0] != 5 {
+		t.Errorf("expected a single run with 5; got %v", got)
+	}
+	for _, res := range results {
+		if res != 5 {
+			t.Errorf("expected every caller to get 5; got %v", results)
+			break
+		}
+	}
+}
+
+// TestDebounceLeading tests that a burst runs once with the first request
+// and starts again after a quiet period.
+func TestDebounceLeading(t *testing.T) {
+	circuit, runs := recordingCircuit()
+	d := DebounceOf(circuit, DebounceSettings{Mode: DebounceLeading, Wait: 30 * time.Millisecond})
+
+	results := callConcurrently(d, 5)
+
+	if got := runs(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("expected a single run with 1; got %v", got)
+	}
+	if results[4] != 1 {
+		t.Errorf("expected later callers to get 1; got %v", results)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if res, _ := d.Call(context.Background(), 9); res != 9 {
+		t.Error("expected a new run after a quiet period; got", res)
+	}
+}
+
+// TestDebounceLeadingCancel tests that the leading caller can give up when
+// its context ends, while the run continues for the other callers.
+func TestDebounceLeadingCancel(t *testing.T) {
+	release := make(chan struct{})
+	d := DebounceOf(func(ctx context.Context, n int) (int, error) {
+		<-release
+		return n, nil
+	}, DebounceSettings{Mode: DebounceLeading, Wait: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := d.Call(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected context.DeadlineExceeded; got", err)
+	}
+
+	results := make(chan int, 1)
+	go func() {
+		res, _ := d.Call(context.Background(), 2)
+		results <- res
+	}()
+
+	close(release)
+	if res := <-results; res != 1 {
+		t.Error("expected the leading result 1; got", res)
+	}
+}
+
+// TestDebounceBoth tests that a burst runs on both edges.
+func TestDebounceBoth(t *testing.T) {
+	circuit, runs := recordingCircuit()
+	d := DebounceOf(circuit, DebounceSettings{Mode: DebounceBoth, Wait: 30 * time.Millisecond})
+
+	results := callConcurrently(d, 5)
+
+	if got := runs(); len(got) != 2 || got[0] != 1 || got[1] != 5 {
+		t.Errorf("expected runs with 1 and 5; got %v", got)
+	}
+	if results[0] != 1 || results[4] != 5 {
+		t.Errorf("expected the first caller to get 1 and the last 5; got %v", results)
+	}
+
+	// A single call only runs on the leading edge.
+	time.Sleep(60 * time.Millisecond)
+	d.Call(context.Background(), 7)
+	time.Sleep(60 * time.Millisecond)
+
+	if got := runs(); len(got) != 3 {
+		t.Errorf("expected a single extra run; got %v", got)
+	}
+}
+
+// TestDebounceMaxWait tests that a constant stream of calls still runs
+// periodically.
+func TestDebounceMaxWait(t *testing.T) {
+	var runs atomic.Int32
+	d := Debounce(func(ctx context.Context) (string, error) {
+		runs.Add(1)
+		return "ok", nil
+	}, DebounceSettings{Wait: 30 * time.Millisecond, MaxWait: 60 * time.Millisecond})
+
+	stop := time.After(250 * time.Millisecond)
+	wg := sync.WaitGroup{}
+
+loop:
+	for {
+		select {
+		case <-stop:
+			break loop
+		default:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Call(context.Background(), struct{}{})
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	wg.Wait()
+
+	if n := runs.Load(); n < 3 {
+		t.Errorf("expected at least 3 runs during the stream; got %d", n)
+	}
+}
+
+// TestDebounceFlushAndCancel tests that Flush runs and Cancel drops the
+// pending call.
+func TestDebounceFlushAndCancel(t *testing.T) {
+	circuit, runs := recordingCircuit()
+	d := DebounceOf(circuit, DebounceSettings{Wait: time.Hour})
+
+	results := make(chan error, 1)
+	go func() {
+		_, err := d.Call(context.Background(), 1)
+		results <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	d.Flush()
+
+	if err := <-results; err != nil {
+		t.Error("expected the flushed call to succeed; got", err)
+	}
+	if got := runs(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("expected a run with 1; got %v", got)
+	}
+
+	go func() {
+		_, err := d.Call(context.Background(), 2)
+		results <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	d.Cancel()
+
+	if err := <-results; !errors.Is(err, ErrDebounceCancelled) {
+		t.Error("expected ErrDebounceCancelled; got", err)
+	}
+	if got := runs(); len(got) != 1 {
+		t.Errorf("expected no further runs; got %v", got)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrCircuitOpen は、回路が開いているため呼び出しが拒否されたことを表すエラーです。
+var ErrCircuitOpen = errors.New("service unreachable")
+
+// ErrTooManyProbes は、半開状態で許可された試行数を超えたため
+// 呼び出しが拒否されたことを表すエラーです。
+var ErrTooManyProbes = errors.New("service unreachable: too many half-open probes")
+
+// ErrTooManyCalls は、リミッターが呼び出しを拒否したことを表すエラーです。
+var ErrTooManyCalls = errors.New("too many calls")
+
+// ErrNoCapacity は、limit が 0 のため決して呼び出しを許可しないリミッターで
+// 待機しようとしたことを表すエラーです。
+var ErrNoCapacity = errors.New("rate limiter has no capacity")
+
+// ErrQueueFull は、待ち行列に空きがないため呼び出しを受け付けられないことを表すエラーです。
+var ErrQueueFull = errors.New("rate limiter queue is full")
+
+// ErrBulkheadFull は、バルクヘッドの同時実行数と待ち行列が埋まっているため、
+// または待機時間の上限を過ぎたため、呼び出しが拒否されたことを表すエラーです。
+var ErrBulkheadFull = errors.New("bulkhead is full")
+
+// ErrRateLimited は、呼び出しの頻度の制限を超えたため呼び出しが拒否されたことを表すエラーです。
+// ErrTooManyCalls と同じ値です。
+var ErrRateLimited = ErrTooManyCalls
+
+// ErrTimeout は、呼び出しが制限時間内に終わらなかったことを表すエラーです。
+var ErrTimeout = errors.New("timeout")
+
+// ErrTooManyAbandoned は、実行中の呼び出し (打ち切られた後も実行を続けているものを含む) が
+// TimeoutOptions.MaxAbandoned に達したため、新しい呼び出しが拒否されたことを表すエラーです。
+var ErrTooManyAbandoned = errors.New("too many abandoned calls")
+
+// CircuitOpenError は、回路が開いているため呼び出しが拒否されたことを表すエラーです。
+// errors.Is で ErrCircuitOpen と比較できます。
+type CircuitOpenError struct {
+	// ReopenAt は回路が再び呼び出しを受け付ける予定の時刻です。
+	ReopenAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v: circuit open until %s", ErrCircuitOpen, e.ReopenAt.Format(time.RFC3339))
+}
+
+// Is は target が ErrCircuitOpen であれば true を返します。
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// RetryAfter は回路が再び呼び出しを受け付けるまでの時間を返します。
+func (e *CircuitOpenError) RetryAfter() time.Duration {
+	return max(time.Until(e.ReopenAt), 0)
+}
+
+// RateLimitError は、呼び出しの頻度の制限を超えたため呼び出しが拒否されたことを表すエラーです。
+// errors.Is で ErrRateLimited と比較できます。
+type RateLimitError struct {
+	// Delay は次の呼び出しが許可されるまでの時間です。分からない場合は 0 です。
+	Delay time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Delay > 0 {
+		return fmt.Sprintf("%v (retry after %v)", ErrRateLimited, e.Delay)
+	}
+	return ErrRateLimited.Error()
+}
+
+// Is は target が ErrRateLimited であれば true を返します。
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// RetryAfter は次の呼び出しが許可されるまでの時間を返します。
+func (e *RateLimitError) RetryAfter() time.Duration {
+	return e.Delay
+}
+
+// TimeoutError は、呼び出しが Timeout の時間内に終わらなかったことを表すエラーです。
+// errors.Is で ErrTimeout と context.DeadlineExceeded の両方と比較できます。
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v after %v", ErrTimeout, e.Timeout)
+}
+
+// Is は target が ErrTimeout か context.DeadlineExceeded であれば true を返します。
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout || target == context.DeadlineExceeded
+}
+
+// HTTPStatus は err に対応する HTTP のステータスコードを返します。
+// 頻度の制限による拒否は 429、ブレーカーやバルクヘッドなどの保護機構による拒否は 503、
+// タイムアウトは 504、その他のエラーは 500 です。err が nil の場合は 200 を返します。
+func HTTPStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrQueueFull):
+		return http.StatusTooManyRequests
+	case IsRejected(err):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WriteError は、err に対応するステータスコードのエラーレスポンスを w に書き込みます。
+// err が再試行までの待機時間を持つ場合は、その秒数を Retry-After ヘッダーに設定します。
+func WriteError(w http.ResponseWriter, err error) {
+	status := HTTPStatus(err)
+
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		if delay, ok := retryAfter(err); ok {
+			seconds := int((delay + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		}
+	}
+
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestWrapperErrorsAreSentinels tests that the wrappers return errors that
+// can be compared with errors.Is and carry a retry hint.
+func TestWrapperErrorsAreSentinels(t *testing.T) {
+	ctx := context.Background()
+
+	breaker := Breaker(func(ctx context.Context) (string, error) {
+		return "", errors.New("down")
+	}, 0)
+	breaker(ctx)
+
+	_, err := breaker(ctx)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected ErrCircuitOpen; got", err)
+	}
+	if hint, ok := retryAfter(err); !ok || hint <= 0 {
+		t.Errorf("expected a reopen hint; got %v, %v", hint, ok)
+	}
+
+	throttle := Throttle(func(ctx context.Context) (string, error) {
+		return "ok", nil
+	}, 1, 1, time.Minute)
+	throttle(ctx)
+
+	_, err = throttle(ctx)
+	if !errors.Is(err, ErrRateLimited) || !errors.Is(err, ErrTooManyCalls) {
+		t.Error("expected ErrRateLimited; got", err)
+	}
+	if hint, ok := retryAfter(err); !ok || hint <= 0 || hint > time.Minute {
+		t.Errorf("expected a retry hint of up to 1m; got %v, %v", hint, ok)
+	}
+
+	timeout := &TimeoutError{Timeout: time.Second}
+	if !errors.Is(timeout, ErrTimeout) || !errors.Is(timeout, context.DeadlineExceeded) {
+		t.Error("expected TimeoutError to match ErrTimeout and context.DeadlineExceeded")
+	}
+}
+
+// TestHTTPStatus tests the mapping from errors to HTTP status codes.
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, http.StatusOK},
+		{&RateLimitError{Delay: time.Second}, http.StatusTooManyRequests},
+		{ErrQueueFull, http.StatusTooManyRequests},
+		{&CircuitOpenError{ReopenAt: time.Now()}, http.StatusServiceUnavailable},
+		{fmt.Errorf("wrapped: %w", ErrBulkheadFull), http.StatusServiceUnavailable},
+		{ErrConcurrencyLimit, http.StatusServiceUnavailable},
+		{&TimeoutError{Timeout: time.Second}, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if got := HTTPStatus(tt.err); got != tt.want {
+			t.Errorf("HTTPStatus(%v) = %d; want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestWriteError tests that WriteError sets the status and Retry-After header.
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteError(rec, &RateLimitError{Delay: 1500 * time.Millisecond})
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429; got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("expected Retry-After 2; got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	WriteError(rec, ErrBulkheadFull)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503; got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("expected no Retry-After; got %q", got)
+	}
+}
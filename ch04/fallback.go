@@ -0,0 +1,149 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// staleCacheShards は StaleCacheOf が使う ShardedMap のシャード数です。
+const staleCacheShards = 16
+
+// IsRejected は、err がブレーカーやリミッター、バルクヘッドが呼び出しを
+// 拒否したことを表すエラーであれば true を返します。
+// Fallback の when に渡して、保護機構が働いたときだけ代替の処理に切り替えられます。
+func IsRejected(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, ErrTooManyProbes) ||
+		errors.Is(err, ErrTooManyCalls) ||
+		errors.Is(err, ErrQueueFull) ||
+		errors.Is(err, ErrConcurrencyLimit) ||
+		errors.Is(err, ErrBulkheadFull) ||
+		errors.Is(err, ErrTooManyAbandoned)
+}
+
+// Fallback は、primary が失敗し、when がそのエラーに対して true を返した場合に
+// fallback を呼び出すラッパーを返します。when が nil の場合は全てのエラーで fallback を呼び出します。
+// fallback も失敗した場合は、両方のエラーをまとめたエラーを返します。
+func Fallback(primary, fallback Circuit, when func(error) bool) Circuit {
+	return untyped(FallbackOf(primary.typed(), fallback.typed(), when))
+}
+
+// FallbackOf は Fallback の型パラメータ版です。
+func FallbackOf[Req, Resp any](primary, fallback CircuitOf[Req, Resp], when func(error) bool) CircuitOf[Req, Resp] {
+	return func(ctx context.Context, req Req) (Resp, error) {
+		response, err := primary(ctx, req)
+		if err == nil || (when != nil && !when(err)) {
+			return response, err
+		}
+
+		response, ferr := fallback(ctx, req)
+		if ferr != nil {
+			return response, errors.Join(err, ferr)
+		}
+
+		return response, nil
+	}
+}
+
+// staleEntry は StaleCacheOf が保持する最後に成功したレスポンスです。
+type staleEntry[Resp any] struct {
+	response Resp
+	at       time.Time // レスポンスを受け取った時刻。ゼロ値はエントリがないことを表す
+}
+
+// StaleCache は、circuit が成功するたびにレスポンスを保持し、circuit が失敗して
+// when がそのエラーに対して true を返した場合に、maxStale 以内に受け取った
+// 最後のレスポンスを代わりに返すラッパーを返します。when が nil の場合は全てのエラーが対象です。
+// 返せるレスポンスがない場合は circuit のエラーをそのまま返します。
+func StaleCache(circuit Circuit, maxStale time.Duration, when func(error) bool) Circuit {
+	return untyped(StaleCacheOf(circuit.typed(), maxStale, when))
+}
+
+// StaleCacheOf は StaleCache の型パラメータ版です。レスポンスはリクエストごとに保持されます。
+// maxStale より古くなったレスポンスは、新しいレスポンスを保持する際にまとめて削除されます。
+func StaleCacheOf[Req comparable, Resp any](circuit CircuitOf[Req, Resp], maxStale time.Duration, when func(error) bool) CircuitOf[Req, Resp] {
+	cache := newStaleCache[Req, Resp](maxStale)
+
+	return func(ctx context.Context, req Req) (Resp, error) {
+		response, err := circuit(ctx, req)
+		if err == nil {
+			cache.set(req, response)
+			return response, nil
+		}
+
+		if when != nil && !when(err) {
+			return response, err
+		}
+
+		stale, ok := cache.get(req)
+		if !ok {
+			return response, err
+		}
+
+		return stale, nil
+	}
+}
+
+// staleCache は StaleCacheOf がリクエストごとのレスポンスを保持するキャッシュです。
+type staleCache[Req comparable, Resp any] struct {
+	entries   ShardedMap[Req, staleEntry[Resp]]
+	maxStale  time.Duration
+	lastSweep atomic.Int64 // 最後に古いエントリを削除した時刻 (UnixNano)
+}
+
+func newStaleCache[Req comparable, Resp any](maxStale time.Duration) *staleCache[Req, Resp] {
+	c := &staleCache[Req, Resp]{
+		entries:  NewShardedMap[Req, staleEntry[Resp]](staleCacheShards),
+		maxStale: maxStale,
+	}
+	c.lastSweep.Store(time.Now().UnixNano())
+	return c
+}
+
+// set は req のレスポンスを保持します。前回の削除から maxStale 以上経っていれば、
+// maxStale より古いエントリを全て削除して、キャッシュが際限なく大きくならないようにします。
+func (c *staleCache[Req, Resp]) set(req Req, response Resp) {
+	now := time.Now()
+	c.entries.Set(req, staleEntry[Resp]{response: response, at: now})
+
+	last := c.lastSweep.Load()
+	if now.UnixNano()-last < int64(c.maxStale) || !c.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	c.entries.DeleteFunc(func(_ Req, e staleEntry[Resp]) bool {
+		return now.Sub(e.at) > c.maxStale
+	})
+}
+
+// get は maxStale 以内に受け取った req のレスポンスを返します。
+// 該当するレスポンスがない場合、ok は false です。
+func (c *staleCache[Req, Resp]) get(req Req) (response Resp, ok bool) {
+	entry := c.entries.Get(req)
+	if entry.at.IsZero() {
+		return response, false
+	}
+	if time.Since(entry.at) > c.maxStale {
+		c.entries.Delete(req)
+		return response, false
+	}
+	return entry.response, true
+}
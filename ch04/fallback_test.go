@@ -0,0 +1,121 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestFallback tests that the fallback is only used for matching errors.
+func TestFallback(t *testing.T) {
+	primary := func(ctx context.Context) (string, error) {
+		return "", ErrCircuitOpen
+	}
+	fallback := func(ctx context.Context) (string, error) {
+		return "degraded", nil
+	}
+
+	res, err := Fallback(primary, fallback, IsRejected)(context.Background())
+	if err != nil || res != "degraded" {
+		t.Errorf("expected the fallback; got %q, %v", res, err)
+	}
+
+	_, err = Fallback(failAfter(0), fallback, IsRejected)(context.Background())
+	if err == nil {
+		t.Error("expected the primary error for a non-matching error")
+	}
+
+	res, err = Fallback(failAfter(0), fallback, nil)(context.Background())
+	if err != nil || res != "degraded" {
+		t.Errorf("expected the fallback with a nil predicate; got %q, %v", res, err)
+	}
+}
+
+// TestFallbackBothFail tests that both errors are reported when the
+// fallback also fails.
+func TestFallbackBothFail(t *testing.T) {
+	errFallback := errors.New("fallback failed")
+
+	f := FallbackOf(func(ctx context.Context, key string) (string, error) {
+		return "", ErrTooManyCalls
+	}, func(ctx context.Context, key string) (string, error) {
+		return "", errFallback
+	}, nil)
+
+	_, err := f(context.Background(), "key")
+	if !errors.Is(err, ErrTooManyCalls) || !errors.Is(err, errFallback) {
+		t.Error("expected both errors; got", err)
+	}
+}
+
+// TestStaleCache tests that the last good response for each request is
+// served while it's fresh enough.
+func TestStaleCache(t *testing.T) {
+	fail := false
+	calls := 0
+
+	cached := StaleCacheOf(func(ctx context.Context, key string) (string, error) {
+		calls++
+		if fail {
+			return "", ErrCircuitOpen
+		}
+		return fmt.Sprintf("%s-%d", key, calls), nil
+	}, 100*time.Millisecond, IsRejected)
+
+	ctx := context.Background()
+
+	cached(ctx, "alpha")
+	fail = true
+
+	if res, err := cached(ctx, "alpha"); err != nil || res != "alpha-1" {
+		t.Errorf("expected the stale response; got %q, %v", res, err)
+	}
+
+	if _, err := cached(ctx, "beta"); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected no stale response for another key; got", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err := cached(ctx, "alpha"); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("expected the stale response to have expired; got", err)
+	}
+}
+
+// TestStaleCachePrune tests that entries older than maxStale are removed
+// once a new response is stored, so the cache doesn't grow without bound.
+func TestStaleCachePrune(t *testing.T) {
+	cache := newStaleCache[int, string](20 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		cache.set(i, "old")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	cache.set(-1, "new")
+
+	if n := cache.entries.Len(); n != 1 {
+		t.Errorf("expected only the new entry to remain; got %d entries", n)
+	}
+	if res, ok := cache.get(-1); !ok || res != "new" {
+		t.Errorf("expected the new entry; got %q, %v", res, ok)
+	}
+}
@@ -49,20 +49,14 @@ func (f *InnerFuture) Result() (string, error) {
 	return f.res, f.err
 }
 
+// SlowFunction は、2秒後に結果を返す処理を Go で非同期に実行します。
 func SlowFunction(ctx context.Context) Future {
-	resCh := make(chan string)
-	errCh := make(chan error)
-
-	go func() {
+	return Go(ctx, func(ctx context.Context) (string, error) {
 		select {
 		case <-time.After(time.Second * 2):
-			resCh <- "I slept for 2 seconds"
-			errCh <- nil
+			return "I slept for 2 seconds", nil
 		case <-ctx.Done():
-			resCh <- ""
-			errCh <- ctx.Err()
+			return "", ctx.Err()
 		}
-	}()
-
-	return &InnerFuture{resCh: resCh, errCh: errCh}
+	})
 }
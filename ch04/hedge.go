@@ -0,0 +1,202 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// hedgeSamples は、パーセンタイルの計算のために保持する所要時間の数です。
+const hedgeSamples = 128
+
+// hedgeMinSamples は、計測した所要時間からパーセンタイルを計算するために必要な数です。
+// それより少ない間は HedgeOptions.Delay を使います。
+const hedgeMinSamples = 20
+
+// HedgeOptions は HedgeWith の設定です。
+type HedgeOptions struct {
+	// Attempts は、最初の試行を含めた最大の試行回数です。既定値は 2 です。
+	Attempts int
+
+	// Delay は、次の試行を開始するまでの待機時間です。
+	// Percentile が設定されている場合は、計測した所要時間が十分に集まるまで使われます。
+	Delay time.Duration
+
+	// Percentile が 0 より大きい場合、最初の試行の所要時間のパーセンタイル
+	// (例えば 95) を次の試行を開始するまでの待機時間にします。最初の試行が追加の試行に
+	// 先を越された場合は、その時点までの時間を所要時間として記録します。
+	Percentile float64
+
+	// Budget が設定されている場合、2回目以降の試行ごとに予算を差し引き、予算が尽きると
+	// 追加の試行を行いません。呼び出しが成功すると予算を加えます。
+	Budget *RetryBudget
+}
+
+// Hedge は、circuit の呼び出しが delay の間に終わらなければ同じ呼び出しを追加で開始し、
+// 最初に成功した結果を返すラッパーを返します。attempts は最初の呼び出しを含めた最大の試行回数です。
+// 結果が返された時点で、残りの試行はコンテキストのキャンセルで打ち切られます。
+func Hedge(circuit Circuit, delay time.Duration, attempts int) Circuit {
+	return untyped(HedgeOf(circuit.typed(), delay, attempts))
+}
+
+// HedgeOf は Hedge の型パラメータ版です。
+func HedgeOf[Req, Resp any](circuit CircuitOf[Req, Resp], delay time.Duration, attempts int) CircuitOf[Req, Resp] {
+	return HedgeWith(circuit, HedgeOptions{Attempts: attempts, Delay: delay})
+}
+
+// HedgeWith は、opts に従って circuit の呼び出しを追加で開始するラッパーを返します。
+// 試行が失敗し、他に実行中の試行がない場合は、待機せずに次の試行を開始します。
+// 全ての試行が失敗した場合は最後のエラーを返します。
+func HedgeWith[Req, Resp any](circuit CircuitOf[Req, Resp], opts HedgeOptions) CircuitOf[Req, Resp] {
+	type result struct {
+		response Resp
+		err      error
+		first    bool // 最初の試行の結果かどうか
+	}
+
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = 2
+	}
+
+	latencies := newLatencyTracker(hedgeSamples)
+
+	return func(ctx context.Context, req Req) (Resp, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel() // Cancel the losers
+
+		results := make(chan result, attempts)
+		launched, pending := 0, 0
+		start := time.Now()
+		firstDone := false
+
+		launch := func() bool {
+			if launched > 0 && opts.Budget != nil && !opts.Budget.Withdraw() {
+				return false
+			}
+
+			first := launched == 0
+			launched++
+			pending++
+
+			go func() {
+				response, err := circuit(ctx, req)
+				results <- result{response, err, first}
+			}()
+
+			return true
+		}
+
+		delay := opts.Delay
+		if opts.Percentile > 0 {
+			if p, ok := latencies.percentile(opts.Percentile); ok {
+				delay = p
+			}
+		}
+
+		launch()
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		var zero Resp
+		var lastErr error
+
+		for {
+			select {
+			case res := <-results:
+				pending--
+
+				if res.err == nil {
+					// 最初の試行の所要時間を記録する。追加の試行が先に成功した場合、
+					// 最初の試行には少なくともここまでの時間がかかっている
+					if res.first || !firstDone {
+						latencies.record(time.Since(start))
+					}
+					if opts.Budget != nil {
+						opts.Budget.Deposit()
+					}
+					return res.response, nil
+				}
+
+				if res.first {
+					firstDone = true
+				}
+
+				lastErr = res.err
+
+				if pending == 0 && (launched == attempts || !launch()) {
+					return zero, lastErr
+				}
+
+			case <-timer.C:
+				if launched < attempts && launch() && launched < attempts {
+					timer.Reset(delay)
+				}
+
+			case <-ctx.Done():
+				return zero, ctx.Err()
+			}
+		}
+	}
+}
+
+// latencyTracker は直近の所要時間を保持し、パーセンタイルを計算します。
+type latencyTracker struct {
+	m       sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{samples: make([]time.Duration, 0, size)}
+}
+
+// record は所要時間を記録します。保持できる数を超えた場合は最も古いものを上書きします。
+func (t *latencyTracker) record(d time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if len(t.samples) < cap(t.samples) {
+		t.samples = append(t.samples, d)
+		return
+	}
+
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % len(t.samples)
+}
+
+// percentile は記録した所要時間の p パーセンタイルを返します。
+// 記録が hedgeMinSamples に満たない場合は false を返します。
+func (t *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	t.m.Lock()
+	sorted := slices.Clone(t.samples)
+	t.m.Unlock()
+
+	if len(sorted) < hedgeMinSamples {
+		return 0, false
+	}
+
+	slices.Sort(sorted)
+
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(0, min(i, len(sorted)-1))], true
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestHedgeFirstSuccessWins tests that a hedged attempt returns before a
+// slow first attempt, and that the slow attempt is cancelled.
+func TestHedgeFirstSuccessWins(t *testing.T) {
+	var calls atomic.Int32
+	cancelled := make(chan struct{})
+
+	circuit := func(ctx context.Context) (string, error) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-time.After(time.Second):
+				return "slow", nil
+			case <-ctx.Done():
+				close(cancelled)
+				return "", ctx.Err()
+			}
+		}
+		return "fast", nil
+	}
+
+	hedged := Hedge(circuit, 50*time.Millisecond, 2)
+
+	start := time.Now()
+	res, err := hedged(context.Background())
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if res != "fast" {
+		t.Error("expected fast; got", res)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("expected the hedged attempt to win quickly; took", elapsed)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("expected the slow attempt to be cancelled")
+	}
+}
+
+// TestHedgeAllFail tests that the last error is returned after every
+// attempt has failed, and that failures trigger the next attempt right away.
+func TestHedgeAllFail(t *testing.T) {
+	var calls atomic.Int32
+
+	hedged := HedgeOf(func(ctx context.Context, key string) (string, error) {
+		calls.Add(1)
+		return "", errors.New("INTENTIONAL FAIL!")
+	}, time.Minute, 3)
+
+	start := time.Now()
+	if _, err := hedged(context.Background(), "key"); err == nil {
+		t.Error("expected an error")
+	}
+
+	if calls.Load() != 3 {
+		t.Error("expected 3 attempts; got", calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("expected failed attempts not to wait for the delay; took", elapsed)
+	}
+}
+
+// TestHedgePercentile tests that the hedge delay follows the observed
+// latency percentile once enough samples have been collected.
+func TestHedgePercentile(t *testing.T) {
+	tracker := newLatencyTracker(hedgeSamples)
+
+	if _, ok := tracker.percentile(95); ok {
+		t.Error("expected no percentile without samples")
+	}
+
+	for i := 1; i <= 100; i++ {
+		tracker.record(time.Duration(i) * time.Millisecond)
+	}
+
+	if p, ok := tracker.percentile(95); !ok || p != 95*time.Millisecond {
+		t.Error("expected a p95 of 95ms; got", p)
+	}
+}
+
+// TestHedgeBudget tests that hedged attempts draw from a RetryBudget.
+func TestHedgeBudget(t *testing.T) {
+	var calls atomic.Int32
+
+	hedged := HedgeWith(func(ctx context.Context, _ struct{}) (string, error) {
+		calls.Add(1)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}, HedgeOptions{Attempts: 5, Delay: 10 * time.Millisecond, Budget: NewRetryBudget(0.1, 2)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	hedged(ctx, struct{}{})
+
+	if calls.Load() != 3 {
+		t.Error("expected 1 attempt plus 2 budgeted hedges; got", calls.Load())
+	}
+}
+
+// TestHedgeBudgetDepositOnHedgeWin tests that a success refills the budget
+// even when a hedged attempt wins.
+func TestHedgeBudgetDepositOnHedgeWin(t *testing.T) {
+	var calls atomic.Int32
+
+	budget := NewRetryBudget(1, 2)
+	hedged := HedgeWith(func(ctx context.Context, _ struct{}) (string, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return "hedged", nil
+	}, HedgeOptions{Attempts: 2, Delay: 10 * time.Millisecond, Budget: budget})
+
+	if res, err := hedged(context.Background(), struct{}{}); err != nil || res != "hedged" {
+		t.Fatalf("expected the hedged result; got %q, %v", res, err)
+	}
+
+	if n := budget.Available(); n != 2 {
+		t.Error("expected the hedge to be paid back; got", n)
+	}
+}
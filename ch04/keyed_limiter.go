@@ -0,0 +1,154 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// keyedLimiterShards は KeyedLimiter が使う ShardedMap のシャード数です。
+const keyedLimiterShards = 32
+
+// keyedBucket は KeyedLimiter がキーごとに保持するバケットです。
+type keyedBucket struct {
+	*TokenBucket
+	lastUsed atomic.Int64 // 最後に使われた時刻 (UnixNano)
+}
+
+// KeyedLimiter は、クライアントの IP アドレスや API キーなど、キーごとに
+// 独立した TokenBucket で呼び出しを制限するリミッターです。
+// バケットは ShardedMap に保持され、ttl の間使われずに満杯に戻ったバケットは
+// バックグラウンドのゴルーチンによって破棄されます。
+type KeyedLimiter[K comparable] struct {
+	max      uint
+	refill   uint
+	interval time.Duration
+	ttl      time.Duration
+
+	buckets ShardedMap[K, *keyedBucket]
+
+	stopper
+}
+
+// NewKeyedLimiter は、キーごとに最大 max 個のトークンを持ち、d ごとに refill 個の
+// トークンを補充する KeyedLimiter を作成します。ttl が 0 より大きい場合、
+// ttl の間使われなかったバケットを破棄するゴルーチンを開始します。
+// 不要になったら Stop を呼び出してゴルーチンを終了させる必要があります。
+func NewKeyedLimiter[K comparable](max uint, refill uint, d time.Duration, ttl time.Duration) *KeyedLimiter[K] {
+	l := &KeyedLimiter[K]{
+		max:      max,
+		refill:   refill,
+		interval: d,
+		ttl:      ttl,
+		buckets:  NewShardedMap[K, *keyedBucket](keyedLimiterShards),
+		stopper:  stopper{stopped: make(chan struct{})},
+	}
+
+	if ttl > 0 {
+		go l.evictLoop()
+	}
+
+	return l
+}
+
+// bucket は key のバケットを返します。バケットがなければ作成します。
+func (l *KeyedLimiter[K]) bucket(key K) *keyedBucket {
+	b := l.buckets.GetOrCreate(key, func() *keyedBucket {
+		b := &keyedBucket{TokenBucket: NewTokenBucket(l.max, l.refill, l.interval)}
+		// 作成から Store までの間に evict で破棄されないよう、ここで初期化する
+		b.lastUsed.Store(time.Now().UnixNano())
+		return b
+	})
+	b.lastUsed.Store(time.Now().UnixNano())
+
+	return b
+}
+
+// Allow は、key のバケットにトークンがあれば1つ消費して true を返します。
+func (l *KeyedLimiter[K]) Allow(key K) bool {
+	if l.isStopped() {
+		return false
+	}
+
+	return l.bucket(key).Allow()
+}
+
+// Reserve は key のバケットからトークンを1つ予約します。
+// リミッターが停止している場合は OK が false の Reservation を返します。
+func (l *KeyedLimiter[K]) Reserve(key K) *Reservation {
+	if l.isStopped() {
+		return &Reservation{}
+	}
+
+	return l.bucket(key).Reserve()
+}
+
+// Wait は key のバケットにトークンが利用可能になるまで待機します。
+// 待機の扱いは TokenBucket.Wait と同じです。
+func (l *KeyedLimiter[K]) Wait(ctx context.Context, key K) error {
+	if l.isStopped() {
+		return ErrLimiterStopped
+	}
+
+	return l.bucket(key).Wait(ctx)
+}
+
+// Len は現在保持しているバケットの数を返します。
+func (l *KeyedLimiter[K]) Len() int {
+	return l.buckets.Len()
+}
+
+// Stop はバケットを破棄するゴルーチンを終了させ、全てのバケットを停止します。
+// 以降の Allow は false を、Wait は ErrLimiterStopped を返します。
+func (l *KeyedLimiter[K]) Stop() {
+	l.stopper.Stop()
+
+	l.buckets.DeleteFunc(func(_ K, b *keyedBucket) bool {
+		b.Stop()
+		return true
+	})
+}
+
+// minEvictInterval は evict を呼び出す間隔の下限です。
+const minEvictInterval = time.Millisecond
+
+// evictLoop は ttl の半分ごとに evict を呼び出します。ただし間隔は minEvictInterval 以上です。
+func (l *KeyedLimiter[K]) evictLoop() {
+	ticker := time.NewTicker(max(l.ttl/2, minEvictInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stopped:
+			return
+		case now := <-ticker.C:
+			l.evict(now)
+		}
+	}
+}
+
+// evict は、ttl の間使われず、満杯に戻ったバケットを破棄します。
+// 満杯でないバケットを破棄すると、作り直したバケットで制限を超えてしまうため残します。
+func (l *KeyedLimiter[K]) evict(now time.Time) {
+	idleSince := now.Add(-l.ttl).UnixNano()
+
+	l.buckets.DeleteFunc(func(_ K, b *keyedBucket) bool {
+		return b.lastUsed.Load() < idleSince && b.Tokens() >= int(l.max)
+	})
+}
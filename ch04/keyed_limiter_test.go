@@ -0,0 +1,107 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestKeyedLimiterIndependentKeys tests that each key has its own bucket.
+func TestKeyedLimiterIndependentKeys(t *testing.T) {
+	limiter := NewKeyedLimiter[string](2, 1, time.Minute, 0)
+	defer limiter.Stop()
+
+	for _, key := range []string{"10.0.0.1", "10.0.0.2"} {
+		if !limiter.Allow(key) || !limiter.Allow(key) {
+			t.Errorf("expected 2 calls to be allowed for %s", key)
+		}
+		if limiter.Allow(key) {
+			t.Errorf("expected %s to be limited", key)
+		}
+	}
+
+	if limiter.Len() != 2 {
+		t.Error("expected 2 buckets; got", limiter.Len())
+	}
+}
+
+// TestKeyedLimiterWait tests that Wait blocks until the key's bucket
+// refills.
+func TestKeyedLimiterWait(t *testing.T) {
+	limiter := NewKeyedLimiter[int](1, 1, 100*time.Millisecond, 0)
+	defer limiter.Stop()
+
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := limiter.Wait(ctx, 42); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Error("expected to wait at least 100ms; got", elapsed)
+	}
+}
+
+// TestKeyedLimiterEviction tests that idle, full buckets are evicted after
+// the TTL while buckets that are still refilling are kept.
+func TestKeyedLimiterEviction(t *testing.T) {
+	limiter := NewKeyedLimiter[string](1, 1, time.Minute, 50*time.Millisecond)
+	defer limiter.Stop()
+
+	limiter.Allow("empty") // Leaves an empty bucket
+	limiter.bucket("idle") // Leaves a full bucket
+	time.Sleep(200 * time.Millisecond)
+
+	if limiter.Len() != 1 {
+		t.Fatal("expected only the refilling bucket to remain; got", limiter.Len())
+	}
+	if limiter.Allow("empty") {
+		t.Error("expected the refilling bucket to still be limited")
+	}
+}
+
+// TestKeyedLimiterStop tests that a stopped limiter rejects calls.
+func TestKeyedLimiterStop(t *testing.T) {
+	limiter := NewKeyedLimiter[string](1, 1, time.Minute, time.Minute)
+	limiter.Stop()
+
+	if limiter.Allow("key") {
+		t.Error("expected a stopped limiter to reject calls")
+	}
+	if err := limiter.Wait(context.Background(), "key"); !errors.Is(err, ErrLimiterStopped) {
+		t.Error("expected ErrLimiterStopped; got", err)
+	}
+}
+
+// TestKeyedLimiterTinyTTL tests that a ttl shorter than two nanoseconds
+// doesn't crash the eviction goroutine.
+func TestKeyedLimiterTinyTTL(t *testing.T) {
+	limiter := NewKeyedLimiter[string](1, 1, time.Minute, time.Nanosecond)
+	defer limiter.Stop()
+
+	if !limiter.Allow("key") {
+		t.Error("expected the first call to be allowed")
+	}
+
+	time.Sleep(10 * time.Millisecond) // Let the eviction goroutine run
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter は呼び出しの頻度を制限するリミッターです。
+// TokenBucket、FixedWindowLimiter、SlidingWindowLogLimiter、
+// SlidingWindowCounterLimiter、LeakyBucketLimiter が実装しています。
+type Limiter interface {
+	// Allow は、呼び出しが許可されればその分を消費して true を返します。待機はしません。
+	Allow() bool
+
+	// Wait は呼び出しが許可されるまで待機します。コンテキストの期限までに許可されない場合は
+	// ErrWaitExceedsDeadline を、停止された場合は ErrLimiterStopped を返します。
+	// 待っても許可されることがない場合は、待機せずに ErrNoCapacity や ErrNoRefill を返します。
+	Wait(ctx context.Context) error
+
+	// Stop はリミッターを停止し、待機中の Wait を終了させます。
+	Stop()
+}
+
+// retryAfterLimiter は、呼び出しを拒否したときに次に許可されるまでの時間も返せる Limiter です。
+// このパッケージのリミッターは全てこれを実装しています。
+type retryAfterLimiter interface {
+	// allow は Allow と同じですが、拒否した場合は次の呼び出しが許可されるまでの時間も返します。
+	// 時間が分からない場合は 0 を返します。
+	allow() (bool, time.Duration)
+}
+
+// Limit は、l が許可しない呼び出しを *RateLimitError で拒否する Effector を返します。
+// l がこのパッケージのリミッターであれば、RateLimitError.Delay に次の呼び出しが
+// 許可されるまでの時間を設定します。エラーは errors.Is で ErrTooManyCalls と比較できます。
+func Limit(e Effector, l Limiter) Effector {
+	return Effector(untyped(LimitOf(e.typed(), l)))
+}
+
+// LimitOf は Limit の型パラメータ版です。
+func LimitOf[Req, Resp any](e CircuitOf[Req, Resp], l Limiter) CircuitOf[Req, Resp] {
+	return func(ctx context.Context, req Req) (Resp, error) {
+		var zero Resp
+
+		if ctx.Err() != nil {
+			return zero, ctx.Err()
+		}
+
+		if ok, delay := allow(l); !ok {
+			return zero, &RateLimitError{Delay: delay}
+		}
+
+		return e(ctx, req)
+	}
+}
+
+// allow は l.Allow を呼び出し、拒否された場合は分かれば次に許可されるまでの時間も返します。
+func allow(l Limiter) (bool, time.Duration) {
+	if r, ok := l.(retryAfterLimiter); ok {
+		return r.allow()
+	}
+	return l.Allow(), 0
+}
+
+// LimitWaitOf は、l が呼び出しを許可するまで待機してから e を呼び出す CircuitOf を返します。
+func LimitWaitOf[Req, Resp any](e CircuitOf[Req, Resp], l Limiter) CircuitOf[Req, Resp] {
+	return func(ctx context.Context, req Req) (Resp, error) {
+		if err := l.Wait(ctx); err != nil {
+			var zero Resp
+			return zero, err
+		}
+
+		return e(ctx, req)
+	}
+}
+
+// stopper はリミッターの Stop を実装します。
+// stopped は作成時に make で初期化する必要があります。
+type stopper struct {
+	stop    sync.Once
+	stopped chan struct{}
+}
+
+// Stop は停止を通知します。何度呼び出しても構いません。
+func (s *stopper) Stop() {
+	s.stop.Do(func() { close(s.stopped) })
+}
+
+// isStopped は Stop が呼び出されたかどうかを返します。
+func (s *stopper) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitUntil は、acquire が成功するまで待機と再試行を繰り返します。
+// acquire は許可されなかった場合に、再試行すべきまでの時間を返します。
+func (s *stopper) waitUntil(ctx context.Context, acquire func(now time.Time) (bool, time.Duration)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s.isStopped() {
+			return ErrLimiterStopped
+		}
+
+		now := time.Now()
+		ok, retryIn := acquire(now)
+		if ok {
+			return nil
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && now.Add(retryIn).After(deadline) {
+			return ErrWaitExceedsDeadline
+		}
+
+		timer := time.NewTimer(retryIn)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-s.stopped:
+			timer.Stop()
+			return ErrLimiterStopped
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Limiter = (*LeakyBucketLimiter)(nil)
+
+// LeakyBucketLimiter は、呼び出しを待ち行列に入れ、interval ごとに1つずつ一定の間隔で
+// 通すリミッターです。バーストを許さず、下流への呼び出しを平滑化します。
+// 待ち行列は時刻の予約として表されるため、バックグラウンドのゴルーチンを使いません。
+type LeakyBucketLimiter struct {
+	interval time.Duration
+	capacity int
+
+	m    sync.Mutex
+	next time.Time // 次の呼び出しを通せる時刻
+
+	stopper
+}
+
+// NewLeakyBucketLimiter は、interval ごとに1回の呼び出しを通し、
+// 最大 capacity 個の呼び出しを待たせる LeakyBucketLimiter を作成します。
+func NewLeakyBucketLimiter(interval time.Duration, capacity int) *LeakyBucketLimiter {
+	return &LeakyBucketLimiter{
+		interval: interval,
+		capacity: capacity,
+		stopper:  stopper{stopped: make(chan struct{})},
+	}
+}
+
+// reserve は呼び出しを通す時刻を予約します。
+// 予約した時刻が now より後で wait が false の場合、待ち行列が満杯の場合、
+// 予約した時刻が deadline (ゼロ値でない場合) より後の場合は予約しません。
+func (l *LeakyBucketLimiter) reserve(now time.Time, wait bool, deadline time.Time) (time.Time, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	at := now
+	if l.next.After(now) {
+		at = l.next
+	}
+
+	switch {
+	case at.After(now) && !wait:
+		return at, ErrTooManyCalls
+	case l.interval > 0 && int(at.Sub(now)/l.interval) >= l.capacity && at.After(now):
+		return at, ErrQueueFull
+	case !deadline.IsZero() && at.After(deadline):
+		return at, ErrWaitExceedsDeadline
+	}
+
+	l.next = at.Add(l.interval)
+
+	return at, nil
+}
+
+// cancel は at に予約した呼び出しを取り消します。
+// 後続の予約がない場合に限り、その時刻を次の呼び出しに譲ります。
+func (l *LeakyBucketLimiter) cancel(at time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.next.Equal(at.Add(l.interval)) {
+		l.next = at
+	}
+}
+
+func (l *LeakyBucketLimiter) Allow() bool {
+	ok, _ := l.allow()
+	return ok
+}
+
+func (l *LeakyBucketLimiter) allow() (bool, time.Duration) {
+	if l.isStopped() {
+		return false, 0
+	}
+
+	now := time.Now()
+	at, err := l.reserve(now, false, time.Time{})
+	if err != nil {
+		return false, at.Sub(now)
+	}
+	return true, 0
+}
+
+// Wait は呼び出しの順番が来るまで待機します。
+// 待ち行列が満杯の場合は待機せずに ErrQueueFull を返します。
+func (l *LeakyBucketLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l.isStopped() {
+		return ErrLimiterStopped
+	}
+
+	deadline, _ := ctx.Deadline()
+	now := time.Now()
+
+	at, err := l.reserve(now, true, deadline)
+	if err != nil {
+		return err
+	}
+	if !at.After(now) {
+		return nil
+	}
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel(at)
+		return ctx.Err()
+	case <-l.stopped:
+		l.cancel(at)
+		return ErrLimiterStopped
+	}
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// limiterFactories returns constructors for each Limiter implementation,
+// configured to allow 10 calls per window.
+func limiterFactories(window time.Duration) map[string]func() Limiter {
+	return map[string]func() Limiter{
+		"TokenBucket":          func() Limiter { return NewTokenBucket(10, 10, window) },
+		"FixedWindow":          func() Limiter { return NewFixedWindowLimiter(10, window) },
+		"SlidingWindowLog":     func() Limiter { return NewSlidingWindowLogLimiter(10, window) },
+		"SlidingWindowCounter": func() Limiter { return NewSlidingWindowCounterLimiter(10, window) },
+		"LeakyBucket":          func() Limiter { return NewLeakyBucketLimiter(window/10, 10) },
+	}
+}
+
+// TestLimiterAllow tests that no limiter allows more than 10 immediate calls,
+// and that all of them allow calls again after a window.
+func TestLimiterAllow(t *testing.T) {
+	for name, factory := range limiterFactories(100 * time.Millisecond) {
+		t.Run(name, func(t *testing.T) {
+			l := factory()
+			defer l.Stop()
+
+			allowed := 0
+			for i := 0; i < 100; i++ {
+				if l.Allow() {
+					allowed++
+				}
+			}
+
+			if allowed == 0 || allowed > 10 {
+				t.Error("expected 1 to 10 calls to be allowed; got", allowed)
+			}
+
+			time.Sleep(110 * time.Millisecond)
+
+			if !l.Allow() {
+				t.Error("expected a call to be allowed after the window")
+			}
+		})
+	}
+}
+
+// TestLimiterWait tests that Wait paces 20 calls over at least one window.
+func TestLimiterWait(t *testing.T) {
+	for name, factory := range limiterFactories(100 * time.Millisecond) {
+		t.Run(name, func(t *testing.T) {
+			l := factory()
+			defer l.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			start := time.Now()
+			for i := 0; i < 20; i++ {
+				if err := l.Wait(ctx); err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+			}
+
+			if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+				t.Error("expected to wait about 100ms; got", elapsed)
+			}
+		})
+	}
+}
+
+// TestLimiterStop tests that Stop wakes up pending waiters.
+func TestLimiterStop(t *testing.T) {
+	for name, factory := range limiterFactories(time.Minute) {
+		t.Run(name, func(t *testing.T) {
+			l := factory()
+			for l.Allow() {
+			}
+
+			time.AfterFunc(20*time.Millisecond, l.Stop)
+
+			if err := l.Wait(context.Background()); !errors.Is(err, ErrLimiterStopped) {
+				t.Error("expected ErrLimiterStopped; got", err)
+			}
+		})
+	}
+}
+
+// TestFixedWindowBoundaryBurst demonstrates that a fixed window allows up to
+// twice its limit around a window boundary, while a sliding window log
+// doesn't.
+func TestFixedWindowBoundaryBurst(t *testing.T) {
+	fixed := NewFixedWindowLimiter(5, 100*time.Millisecond)
+	sliding := NewSlidingWindowLogLimiter(5, 100*time.Millisecond)
+
+	time.Sleep(80 * time.Millisecond)
+	fixedAllowed, slidingAllowed := 0, 0
+	for i := 0; i < 5; i++ {
+		if fixed.Allow() {
+			fixedAllowed++
+		}
+		if sliding.Allow() {
+			slidingAllowed++
+		}
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if fixed.Allow() {
+			fixedAllowed++
+		}
+		if sliding.Allow() {
+			slidingAllowed++
+		}
+	}
+
+	if fixedAllowed != 10 {
+		t.Error("expected the fixed window to allow 10; got", fixedAllowed)
+	}
+	if slidingAllowed != 5 {
+		t.Error("expected the sliding window log to allow 5; got", slidingAllowed)
+	}
+}
+
+// TestWindowLimiterNonPositiveWindow tests that a zero or negative window
+// doesn't make the window limiters panic.
+func TestWindowLimiterNonPositiveWindow(t *testing.T) {
+	for _, window := range []time.Duration{0, -time.Second} {
+		limiters := map[string]Limiter{
+			"fixed":   NewFixedWindowLimiter(1, window),
+			"log":     NewSlidingWindowLogLimiter(1, window),
+			"counter": NewSlidingWindowCounterLimiter(1, window),
+		}
+
+		for name, l := range limiters {
+			l.Allow()
+			l.Allow()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			if err := l.Wait(ctx); err != nil {
+				t.Errorf("%s with window %v: unexpected error: %v", name, window, err)
+			}
+			cancel()
+			l.Stop()
+		}
+	}
+}
+
+// TestWindowLimiterNoCapacity tests that window limiters with a zero or
+// negative limit reject every call and fail Wait immediately instead of
+// waking every window forever.
+func TestWindowLimiterNoCapacity(t *testing.T) {
+	for _, limit := range []int{0, -1} {
+		limiters := map[string]Limiter{
+			"fixed":   NewFixedWindowLimiter(limit, time.Millisecond),
+			"log":     NewSlidingWindowLogLimiter(limit, time.Millisecond),
+			"counter": NewSlidingWindowCounterLimiter(limit, time.Millisecond),
+		}
+
+		for name, l := range limiters {
+			if l.Allow() {
+				t.Errorf("%s with limit %d: expected the call to be rejected", name, limit)
+			}
+			if err := l.Wait(context.Background()); !errors.Is(err, ErrNoCapacity) {
+				t.Errorf("%s with limit %d: expected ErrNoCapacity; got %v", name, limit, err)
+			}
+			l.Stop()
+		}
+	}
+}
+
+// TestLeakyBucketQueueFull tests that Wait fails fast once the queue is
+// full.
+func TestLeakyBucketQueueFull(t *testing.T) {
+	l := NewLeakyBucketLimiter(time.Second, 1)
+	defer l.Stop()
+
+	if !l.Allow() {
+		t.Fatal("expected the first call to be allowed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.Wait(ctx) }()
+
+	time.Sleep(20 * time.Millisecond)
+
+	if err := l.Wait(context.Background()); !errors.Is(err, ErrQueueFull) {
+		t.Error("expected ErrQueueFull; got", err)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Error("expected context.Canceled; got", err)
+	}
+}
+
+// TestLimit tests that Limit rejects calls with ErrTooManyCalls.
+func TestLimit(t *testing.T) {
+	callsCounter := 0
+	limited := Limit(callsCountFunction(&callsCounter), NewFixedWindowLimiter(3, time.Minute))
+
+	for i := 0; i < 5; i++ {
+		_, err := limited(context.Background())
+		if i >= 3 && !errors.Is(err, ErrTooManyCalls) {
+			t.Error("expected ErrTooManyCalls; got", err)
+		}
+	}
+
+	if callsCounter != 3 {
+		t.Error("expected 3 calls; got", callsCounter)
+	}
+}
+
+// TestLimitRetryAfter tests that every limiter reports how long to wait when
+// Limit rejects a call.
+func TestLimitRetryAfter(t *testing.T) {
+	for name, factory := range limiterFactories(time.Minute) {
+		l := factory()
+
+		limited := LimitOf(func(ctx context.Context, _ int) (int, error) {
+			return 0, nil
+		}, l)
+
+		var err error
+		for i := 0; i < 20 && err == nil; i++ {
+			_, err = limited(context.Background(), i)
+		}
+
+		var rerr *RateLimitError
+		if !errors.As(err, &rerr) || !errors.Is(err, ErrTooManyCalls) {
+			t.Errorf("%s: expected a RateLimitError; got %v", name, err)
+		} else if rerr.Delay <= 0 || rerr.Delay > time.Minute {
+			t.Errorf("%s: expected a delay within the window; got %v", name, rerr.Delay)
+		}
+
+		l.Stop()
+	}
+}
+
+// BenchmarkLimiterAllow compares the cost and allocations of Allow for each
+// limiter. Run with -benchmem.
+func BenchmarkLimiterAllow(b *testing.B) {
+	for name, factory := range limiterFactories(time.Millisecond) {
+		b.Run(name, func(b *testing.B) {
+			l := factory()
+			defer l.Stop()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				l.Allow()
+			}
+		})
+	}
+}
+
+// BenchmarkLimiterAccuracy hammers each limiter, configured for 10 calls per
+// 10ms, and reports the observed rate relative to the configured rate
+// ("rate-ratio", ideally 1) and the largest number of calls allowed within
+// any 10ms span ("max-burst", ideally 10).
+func BenchmarkLimiterAccuracy(b *testing.B) {
+	const window = 10 * time.Millisecond
+
+	for name, factory := range limiterFactories(window) {
+		b.Run(name, func(b *testing.B) {
+			l := factory()
+			defer l.Stop()
+
+			var allowed []time.Time
+			start := time.Now()
+
+			for i := 0; i < b.N || time.Since(start) < 20*window; i++ {
+				if l.Allow() {
+					allowed = append(allowed, time.Now())
+				}
+			}
+
+			elapsed := time.Since(start)
+			b.ReportMetric(float64(len(allowed))/(float64(elapsed)/float64(window))/10, "rate-ratio")
+
+			burst, j := 0, 0
+			for i := range allowed {
+				for allowed[i].Sub(allowed[j]) >= window {
+					j++
+				}
+				burst = max(burst, i-j+1)
+			}
+			b.ReportMetric(float64(burst), "max-burst")
+		})
+	}
+}
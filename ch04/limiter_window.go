@@ -0,0 +1,247 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	_ Limiter = (*FixedWindowLimiter)(nil)
+	_ Limiter = (*SlidingWindowLogLimiter)(nil)
+	_ Limiter = (*SlidingWindowCounterLimiter)(nil)
+)
+
+// FixedWindowLimiter は、時間を長さ window の区間に区切り、区間ごとに limit 回まで
+// 呼び出しを許可するリミッターです。最も軽量ですが、区間の境目をまたぐと
+// 短い時間に最大で 2*limit 回の呼び出しを許可してしまいます。
+type FixedWindowLimiter struct {
+	limit  int
+	window time.Duration
+
+	m     sync.Mutex
+	start time.Time // 現在の区間の開始時刻
+	count int       // 現在の区間で許可した回数
+
+	stopper
+}
+
+// minWindow は window の下限です。0 以下の window はこの値として扱われます。
+const minWindow = time.Nanosecond
+
+// NewFixedWindowLimiter は、window ごとに limit 回まで呼び出しを許可する FixedWindowLimiter を作成します。
+// window が 0 以下の場合は minWindow を使い、limit が負の場合は 0 として扱います。
+func NewFixedWindowLimiter(limit int, window time.Duration) *FixedWindowLimiter {
+	return &FixedWindowLimiter{
+		limit:   max(limit, 0),
+		window:  max(window, minWindow),
+		start:   time.Now(),
+		stopper: stopper{stopped: make(chan struct{})},
+	}
+}
+
+// acquire は、現在の区間に余裕があれば1回分を消費します。
+// 余裕がなければ次の区間が始まるまでの時間を返します。
+func (l *FixedWindowLimiter) acquire(now time.Time) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if elapsed := now.Sub(l.start); elapsed >= l.window {
+		l.start = l.start.Add(elapsed / l.window * l.window)
+		l.count = 0
+	}
+
+	if l.count < l.limit {
+		l.count++
+		return true, 0
+	}
+
+	return false, l.start.Add(l.window).Sub(now)
+}
+
+func (l *FixedWindowLimiter) Allow() bool {
+	ok, _ := l.allow()
+	return ok
+}
+
+func (l *FixedWindowLimiter) allow() (bool, time.Duration) {
+	if l.isStopped() {
+		return false, 0
+	}
+	return l.acquire(time.Now())
+}
+
+// Wait は呼び出しが許可されるまで待機します。limit が 0 の場合は待機せずに ErrNoCapacity を返します。
+func (l *FixedWindowLimiter) Wait(ctx context.Context) error {
+	if l.limit == 0 {
+		return ErrNoCapacity
+	}
+	return l.waitUntil(ctx, l.acquire)
+}
+
+// SlidingWindowLogLimiter は、許可した呼び出しの時刻を記録し、直近 window の間に
+// limit 回まで呼び出しを許可するリミッターです。制限は正確ですが、
+// limit 個の時刻を保持するためメモリを多く使います。
+type SlidingWindowLogLimiter struct {
+	window time.Duration
+
+	m    sync.Mutex
+	log  []time.Time // 許可した呼び出しの時刻のリングバッファ
+	next int         // log の中で最も古い時刻の位置
+
+	stopper
+}
+
+// NewSlidingWindowLogLimiter は、直近 window の間に limit 回まで呼び出しを許可する
+// SlidingWindowLogLimiter を作成します。window が 0 以下の場合は minWindow を使い、
+// limit が負の場合は 0 として扱います。
+func NewSlidingWindowLogLimiter(limit int, window time.Duration) *SlidingWindowLogLimiter {
+	return &SlidingWindowLogLimiter{
+		window:  max(window, minWindow),
+		log:     make([]time.Time, max(limit, 0)),
+		stopper: stopper{stopped: make(chan struct{})},
+	}
+}
+
+// acquire は、直近 window の間の呼び出しが limit 回未満であれば時刻を記録します。
+// そうでなければ最も古い記録が window の外に出るまでの時間を返します。
+func (l *SlidingWindowLogLimiter) acquire(now time.Time) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if len(l.log) == 0 {
+		return false, l.window
+	}
+
+	oldest := l.log[l.next]
+	if !oldest.IsZero() && now.Sub(oldest) < l.window {
+		return false, oldest.Add(l.window).Sub(now)
+	}
+
+	l.log[l.next] = now
+	l.next = (l.next + 1) % len(l.log)
+
+	return true, 0
+}
+
+func (l *SlidingWindowLogLimiter) Allow() bool {
+	ok, _ := l.allow()
+	return ok
+}
+
+func (l *SlidingWindowLogLimiter) allow() (bool, time.Duration) {
+	if l.isStopped() {
+		return false, 0
+	}
+	return l.acquire(time.Now())
+}
+
+// Wait は呼び出しが許可されるまで待機します。limit が 0 の場合は待機せずに ErrNoCapacity を返します。
+func (l *SlidingWindowLogLimiter) Wait(ctx context.Context) error {
+	if len(l.log) == 0 {
+		return ErrNoCapacity
+	}
+	return l.waitUntil(ctx, l.acquire)
+}
+
+// SlidingWindowCounterLimiter は、直前と現在の区間の呼び出し回数を、区間の経過に
+// 応じて重み付けして足し合わせることで、直近 window の呼び出し回数を推定するリミッターです。
+// FixedWindowLimiter と同程度に軽量で、区間の境目での超過もほとんど起きません。
+type SlidingWindowCounterLimiter struct {
+	limit  int
+	window time.Duration
+
+	m        sync.Mutex
+	start    time.Time // 現在の区間の開始時刻
+	previous int       // 直前の区間で許可した回数
+	current  int       // 現在の区間で許可した回数
+
+	stopper
+}
+
+// NewSlidingWindowCounterLimiter は、直近 window の間に limit 回まで呼び出しを許可する
+// SlidingWindowCounterLimiter を作成します。window が 0 以下の場合は minWindow を使い、
+// limit が負の場合は 0 として扱います。
+func NewSlidingWindowCounterLimiter(limit int, window time.Duration) *SlidingWindowCounterLimiter {
+	return &SlidingWindowCounterLimiter{
+		limit:   max(limit, 0),
+		window:  max(window, minWindow),
+		start:   time.Now(),
+		stopper: stopper{stopped: make(chan struct{})},
+	}
+}
+
+// minRetry は、推定値から計算した再試行までの時間の下限です。
+const minRetry = time.Millisecond
+
+// acquire は、推定した呼び出し回数が limit 未満であれば1回分を消費します。
+// そうでなければ推定値が limit 未満になるまでの時間を返します。
+func (l *SlidingWindowCounterLimiter) acquire(now time.Time) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if elapsed := now.Sub(l.start); elapsed >= l.window {
+		windows := elapsed / l.window
+		l.start = l.start.Add(windows * l.window)
+		if windows == 1 {
+			l.previous = l.current
+		} else {
+			l.previous = 0
+		}
+		l.current = 0
+	}
+
+	elapsed := now.Sub(l.start)
+	weight := 1 - float64(elapsed)/float64(l.window)
+
+	if float64(l.previous)*weight+float64(l.current) < float64(l.limit) {
+		l.current++
+		return true, 0
+	}
+
+	remaining := l.start.Add(l.window).Sub(now)
+	if l.current >= l.limit || l.previous == 0 {
+		return false, max(remaining, minRetry)
+	}
+
+	// previous*(1-t/window) + current < limit となる経過時間 t を求める
+	t := time.Duration((1 - float64(l.limit-l.current)/float64(l.previous)) * float64(l.window))
+
+	return false, max(min(t-elapsed, remaining), minRetry)
+}
+
+func (l *SlidingWindowCounterLimiter) Allow() bool {
+	ok, _ := l.allow()
+	return ok
+}
+
+func (l *SlidingWindowCounterLimiter) allow() (bool, time.Duration) {
+	if l.isStopped() {
+		return false, 0
+	}
+	return l.acquire(time.Now())
+}
+
+// Wait は呼び出しが許可されるまで待機します。limit が 0 の場合は待機せずに ErrNoCapacity を返します。
+func (l *SlidingWindowCounterLimiter) Wait(ctx context.Context) error {
+	if l.limit == 0 {
+		return ErrNoCapacity
+	}
+	return l.waitUntil(ctx, l.acquire)
+}
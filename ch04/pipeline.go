@@ -0,0 +1,237 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Group は、関連するゴルーチンの集まりです。いずれかのゴルーチンがエラーを返すと
+// Context がキャンセルされ、Wait は最初のエラーを返します。
+// FanOut や Pipeline などのステージは Group の上でゴルーチンを起動します。
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+// NewGroup は ctx から派生したコンテキストを持つ Group を返します。
+func NewGroup(ctx context.Context) *Group {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Group{ctx: ctx, cancel: cancel}
+}
+
+// Context は、Group のゴルーチンに渡されるコンテキストを返します。
+// 最初のエラーが起きたときか、Wait が終了したときにキャンセルされます。
+func (g *Group) Context() context.Context {
+	return g.ctx
+}
+
+// Go は f を新しいゴルーチンで実行します。
+func (g *Group) Go(f func(ctx context.Context) error) {
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+
+		if err := f(g.ctx); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel(err)
+			})
+		}
+	}()
+}
+
+// Wait は全てのゴルーチンの終了を待ち、最初のエラーを返します。
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel(g.err)
+	return g.err
+}
+
+// send は ctx が終了していなければ v を out に送ります。
+func send[T any](ctx context.Context, out chan<- T, v T) error {
+	select {
+	case out <- v:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Source は items を順に送るチャネルを返します。
+func Source[T any](g *Group, items ...T) <-chan T {
+	out := make(chan T)
+
+	g.Go(func(ctx context.Context) error {
+		defer close(out)
+
+		for _, item := range items {
+			if err := send(ctx, out, item); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return out
+}
+
+// FanOut は、in から受け取った値を workers 個のゴルーチンで f に渡し、その結果を送るチャネルを返します。
+// 結果の順序は in の順序と一致しません。f がエラーを返すと Group のコンテキストがキャンセルされます。
+func FanOut[T, U any](g *Group, in <-chan T, workers int, f func(context.Context, T) (U, error)) <-chan U {
+	out := make(chan U)
+	workers = max(workers, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for range workers {
+		g.Go(func(ctx context.Context) error {
+			defer wg.Done()
+
+			for {
+				select {
+				case v, ok := <-in:
+					if !ok {
+						return nil
+					}
+
+					u, err := f(ctx, v)
+					if err != nil {
+						return err
+					}
+					if err := send(ctx, out, u); err != nil {
+						return err
+					}
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// FanIn は、ins の全てのチャネルから受け取った値を1つのチャネルにまとめます。
+// 返されるチャネルは、ins が全て閉じられると閉じられます。
+func FanIn[T any](g *Group, ins ...<-chan T) <-chan T {
+	out := make(chan T)
+
+	var wg sync.WaitGroup
+	wg.Add(len(ins))
+
+	for _, in := range ins {
+		g.Go(func(ctx context.Context) error {
+			defer wg.Done()
+
+			for {
+				select {
+				case v, ok := <-in:
+					if !ok {
+						return nil
+					}
+					if err := send(ctx, out, v); err != nil {
+						return err
+					}
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// Pipeline は、in から受け取った値を stages に順に通した結果を送るチャネルを返します。
+// 各ステージは1つのゴルーチンで実行されるため、値の順序は保たれます。
+func Pipeline[T any](g *Group, in <-chan T, stages ...func(context.Context, T) (T, error)) <-chan T {
+	for _, stage := range stages {
+		in = FanOut(g, in, 1, stage)
+	}
+	return in
+}
+
+// Batch は、in から受け取った値を最大 size 個ずつまとめて送るチャネルを返します。
+// maxWait が正の場合、最初の値を受け取ってから maxWait が過ぎると size に満たなくても送ります。
+func Batch[T any](g *Group, in <-chan T, size int, maxWait time.Duration) <-chan []T {
+	out := make(chan []T)
+	size = max(size, 1)
+
+	g.Go(func(ctx context.Context) error {
+		defer close(out)
+
+		var batch []T
+		var timeout <-chan time.Time
+
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			b := batch
+			batch, timeout = nil, nil
+			return send(ctx, out, b)
+		}
+
+		for {
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return flush()
+				}
+
+				if len(batch) == 0 && maxWait > 0 {
+					timeout = time.After(maxWait)
+				}
+
+				batch = append(batch, v)
+				if len(batch) >= size {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+			case <-timeout:
+				if err := flush(); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	return out
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestPipeline tests that values flow through the stages in order.
+func TestPipeline(t *testing.T) {
+	g := NewGroup(context.Background())
+
+	double := func(ctx context.Context, n int) (int, error) { return n * 2, nil }
+	inc := func(ctx context.Context, n int) (int, error) { return n + 1, nil }
+
+	var got []int
+	for n := range Pipeline(g, Source(g, 1, 2, 3), double, inc) {
+		got = append(got, n)
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !slices.Equal(got, []int{3, 5, 7}) {
+		t.Error("expected [3 5 7]; got", got)
+	}
+}
+
+// TestFanOutFanIn tests that FanOut spreads the work and FanIn merges the
+// results.
+func TestFanOutFanIn(t *testing.T) {
+	g := NewGroup(context.Background())
+
+	in := Source(g, 1, 2, 3, 4, 5, 6)
+	toString := func(ctx context.Context, n int) (string, error) {
+		return strconv.Itoa(n), nil
+	}
+
+	var got []string
+	for s := range FanIn(g, FanOut(g, in, 3, toString), Source(g, "x")) {
+		got = append(got, s)
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"1", "2", "3", "4", "5", "6", "x"}) {
+		t.Error("unexpected results:", got)
+	}
+}
+
+// TestFanOutError tests that an error cancels the other stages and is
+// returned by Wait.
+func TestFanOutError(t *testing.T) {
+	g := NewGroup(context.Background())
+	errBad := errors.New("bad value")
+
+	values := make([]int, 1000)
+	out := FanOut(g, Source(g, values...), 4, func(ctx context.Context, n int) (int, error) {
+		return 0, errBad
+	})
+
+	for range out {
+	}
+
+	if err := g.Wait(); !errors.Is(err, errBad) {
+		t.Error("expected the stage error; got", err)
+	}
+	if g.Context().Err() == nil {
+		t.Error("expected the group context to be cancelled")
+	}
+}
+
+// TestPipelineCancel tests that cancelling the parent context stops the
+// stages.
+func TestPipelineCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := NewGroup(ctx)
+
+	out := Source(g, 1, 2, 3)
+	<-out
+	cancel()
+
+	if err := g.Wait(); !errors.Is(err, context.Canceled) {
+		t.Error("expected context.Canceled; got", err)
+	}
+}
+
+// TestBatch tests that values are grouped by size and by maxWait.
+func TestBatch(t *testing.T) {
+	g := NewGroup(context.Background())
+
+	in := make(chan int)
+	batches := Batch(g, in, 3, 20*time.Millisecond)
+
+	go func() {
+		defer close(in)
+		for i := 1; i <= 4; i++ {
+			in <- i
+		}
+		time.Sleep(50 * time.Millisecond) // 4 is sent after maxWait
+		in <- 5
+	}()
+
+	var got [][]int
+	for b := range batches {
+		got = append(got, b)
+	}
+
+	if err := g.Wait(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want := [][]int{{1, 2, 3}, {4}, {5}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Error("expected", want, "got", got)
+	}
+}
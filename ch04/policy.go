@@ -0,0 +1,278 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// policyKind はポリシーの層の種類です。値が小さいほど外側に適用されます。
+type policyKind int
+
+const (
+	policyFallback policyKind = iota
+	policyRetry
+	policyHedge
+	policyBreaker
+	policyLimiter
+	policyConcurrency
+	policyBulkhead
+	policyTimeout
+)
+
+// String は層の種類の名前を返します。
+func (k policyKind) String() string {
+	switch k {
+	case policyFallback:
+		return "Fallback"
+	case policyRetry:
+		return "Retry"
+	case policyHedge:
+		return "Hedge"
+	case policyBreaker:
+		return "CircuitBreaker"
+	case policyLimiter:
+		return "Limiter"
+	case policyConcurrency:
+		return "ConcurrencyLimit"
+	case policyBulkhead:
+		return "Bulkhead"
+	case policyTimeout:
+		return "Timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// policyLayer はポリシーの1つの層です。
+type policyLayer[Req, Resp any] struct {
+	kind   policyKind
+	detail string
+	wrap   func(CircuitOf[Req, Resp]) CircuitOf[Req, Resp]
+}
+
+// String は層の説明を返します。
+func (l policyLayer[Req, Resp]) String() string {
+	if l.detail == "" {
+		return l.kind.String()
+	}
+	return l.kind.String() + "(" + l.detail + ")"
+}
+
+// Policy は、Effector に適用するラッパーを組み立てるビルダーです。
+// ラッパーは With メソッドを呼び出した順序にかかわらず、外側から
+// Fallback、Retry、Hedge、CircuitBreaker、Limiter、ConcurrencyLimit、Bulkhead、Timeout
+// の順に適用されます。これにより、例えばリトライの各試行がブレーカーとタイムアウトを通り、
+// タイムアウトがブレーカーの失敗として数えられます。
+type Policy[Req, Resp any] struct {
+	effector CircuitOf[Req, Resp]
+	layers   []policyLayer[Req, Resp]
+	errs     []error
+
+	// 検証に使う設定
+	retry   RetryOptions
+	timeout time.Duration
+}
+
+// Wrap は effector に適用する Policy を作成します。
+// Build で組み立てた結果は BuildEffector で Effector として取得できます。
+func Wrap(effector Effector) *Policy[struct{}, string] {
+	return WrapOf(effector.typed())
+}
+
+// WrapOf は Wrap の型パラメータ版です。
+func WrapOf[Req, Resp any](effector CircuitOf[Req, Resp]) *Policy[Req, Resp] {
+	return &Policy[Req, Resp]{effector: effector}
+}
+
+// add は層を追加します。同じ種類の層が既にある場合はエラーを記録します。
+func (p *Policy[Req, Resp]) add(kind policyKind, detail string, wrap func(CircuitOf[Req, Resp]) CircuitOf[Req, Resp]) *Policy[Req, Resp] {
+	for _, l := range p.layers {
+		if l.kind == kind {
+			p.errs = append(p.errs, fmt.Errorf("policy: %v is applied more than once", kind))
+			return p
+		}
+	}
+
+	p.layers = append(p.layers, policyLayer[Req, Resp]{kind: kind, detail: detail, wrap: wrap})
+
+	return p
+}
+
+// WithTimeout は、各試行を d で打ち切る層を追加します。
+func (p *Policy[Req, Resp]) WithTimeout(d time.Duration) *Policy[Req, Resp] {
+	if d <= 0 {
+		p.errs = append(p.errs, fmt.Errorf("policy: timeout must be positive, got %v", d))
+	}
+	p.timeout = d
+
+	return p.add(policyTimeout, d.String(), func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return TimeoutAfterOf(c, d)
+	})
+}
+
+// WithRetry は、opts に従ってリトライする層を追加します。
+func (p *Policy[Req, Resp]) WithRetry(opts RetryOptions) *Policy[Req, Resp] {
+	detail := fmt.Sprintf("retries=%d", opts.Retries)
+	if opts.Unlimited {
+		detail = "retries=unlimited"
+	}
+	if opts.MaxElapsed > 0 {
+		detail += fmt.Sprintf(", max-elapsed=%v", opts.MaxElapsed)
+	}
+	p.retry = opts
+
+	return p.add(policyRetry, detail, func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return RetryWith(c, opts)
+	})
+}
+
+// WithHedge は、opts に従って追加の試行を開始する層を追加します。
+func (p *Policy[Req, Resp]) WithHedge(opts HedgeOptions) *Policy[Req, Resp] {
+	detail := fmt.Sprintf("attempts=%d, delay=%v", opts.Attempts, opts.Delay)
+	if opts.Percentile > 0 {
+		detail += fmt.Sprintf(", p%g", opts.Percentile)
+	}
+
+	return p.add(policyHedge, detail, func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return HedgeWith(c, opts)
+	})
+}
+
+// WithBreaker は、cb で保護する層を追加します。
+func (p *Policy[Req, Resp]) WithBreaker(cb *CircuitBreaker) *Policy[Req, Resp] {
+	return p.add(policyBreaker, cb.Name(), func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return ProtectOf(cb, c)
+	})
+}
+
+// WithLimiter は、l が許可しない呼び出しを *RateLimitError で拒否する層を追加します。
+func (p *Policy[Req, Resp]) WithLimiter(l Limiter) *Policy[Req, Resp] {
+	return p.add(policyLimiter, fmt.Sprintf("%T", l), func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return LimitOf(c, l)
+	})
+}
+
+// WithConcurrencyLimit は、l で同時実行数を制限する層を追加します。
+func (p *Policy[Req, Resp]) WithConcurrencyLimit(l *AdaptiveLimiter) *Policy[Req, Resp] {
+	return p.add(policyConcurrency, fmt.Sprintf("%T", l.settings.Algorithm), func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return LimitConcurrencyOf(l, c)
+	})
+}
+
+// WithBulkhead は、b で同時実行数と待ち行列を制限する層を追加します。
+func (p *Policy[Req, Resp]) WithBulkhead(b *Bulkhead) *Policy[Req, Resp] {
+	detail := fmt.Sprintf("max=%d, queue=%d", b.settings.MaxConcurrent, b.settings.MaxQueue)
+
+	return p.add(policyBulkhead, detail, func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return BulkheadOf(b, c)
+	})
+}
+
+// WithFallback は、when が true を返すエラーで fallback を呼び出す層を追加します。
+func (p *Policy[Req, Resp]) WithFallback(fallback CircuitOf[Req, Resp], when func(error) bool) *Policy[Req, Resp] {
+	return p.add(policyFallback, "", func(c CircuitOf[Req, Resp]) CircuitOf[Req, Resp] {
+		return FallbackOf(c, fallback, when)
+	})
+}
+
+// sorted は外側から順に並べた層を返します。
+func (p *Policy[Req, Resp]) sorted() []policyLayer[Req, Resp] {
+	layers := make([]policyLayer[Req, Resp], 0, len(p.layers))
+	for kind := policyFallback; kind <= policyTimeout; kind++ {
+		for _, l := range p.layers {
+			if l.kind == kind {
+				layers = append(layers, l)
+			}
+		}
+	}
+	return layers
+}
+
+// has は kind の層が追加されているかを返します。
+func (p *Policy[Req, Resp]) has(kind policyKind) bool {
+	for _, l := range p.layers {
+		if l.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// validate は組み合わせられない設定を検出します。
+func (p *Policy[Req, Resp]) validate() error {
+	errs := p.errs
+
+	if p.effector == nil {
+		errs = append(errs, errors.New("policy: effector is nil"))
+	}
+
+	if p.has(policyRetry) {
+		if p.retry.Unlimited && p.retry.MaxElapsed <= 0 && p.retry.Budget == nil {
+			errs = append(errs, errors.New("policy: unlimited Retry needs MaxElapsed or Budget"))
+		}
+		if p.has(policyTimeout) && p.retry.MaxElapsed > 0 && p.retry.MaxElapsed < p.timeout {
+			errs = append(errs, fmt.Errorf("policy: Retry max-elapsed %v is shorter than Timeout %v", p.retry.MaxElapsed, p.timeout))
+		}
+	}
+
+	if p.has(policyRetry) && p.has(policyHedge) && !p.has(policyBreaker) {
+		errs = append(errs, errors.New("policy: Retry and Hedge both multiply calls; add a CircuitBreaker to bound them"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Build は、組み立てたラッパーを適用した CircuitOf を返します。
+// 同じ層が2回以上追加された場合や、組み合わせられない設定がある場合はエラーを返します。
+func (p *Policy[Req, Resp]) Build() (CircuitOf[Req, Resp], error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	layers := p.sorted()
+
+	circuit := p.effector
+	for i := len(layers) - 1; i >= 0; i-- {
+		circuit = layers[i].wrap(circuit)
+	}
+
+	return circuit, nil
+}
+
+// BuildEffector は、Wrap で作成した Policy を組み立てて Effector として返します。
+func BuildEffector(p *Policy[struct{}, string]) (Effector, error) {
+	circuit, err := p.Build()
+	if err != nil {
+		return nil, err
+	}
+	return Effector(untyped(circuit)), nil
+}
+
+// String は、適用される層を外側から順に並べた説明を返します。
+func (p *Policy[Req, Resp]) String() string {
+	var b strings.Builder
+	for _, l := range p.sorted() {
+		b.WriteString(l.String())
+		b.WriteString(" -> ")
+	}
+	b.WriteString("effector")
+	return b.String()
+}
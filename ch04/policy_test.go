@@ -0,0 +1,163 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPolicyOrder verifies that layers are applied in the fixed order
+// regardless of the order the With methods were called in.
+func TestPolicyOrder(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerSettings{Name: "backend"})
+
+	p := Wrap(func(ctx context.Context) (string, error) { return "ok", nil }).
+		WithTimeout(time.Second).
+		WithBreaker(cb).
+		WithRetry(RetryOptions{Retries: 3})
+
+	want := "Retry(retries=3) -> CircuitBreaker(backend) -> Timeout(1s) -> effector"
+	if got := p.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	e, err := BuildEffector(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := e(context.Background())
+	if err != nil || res != "ok" {
+		t.Errorf("expected ok, got %q, %v", res, err)
+	}
+}
+
+// TestPolicyRetryWrapsTimeout verifies that each retry attempt gets its own timeout.
+func TestPolicyRetryWrapsTimeout(t *testing.T) {
+	var attempts atomic.Int32
+	effector := func(ctx context.Context, n int) (int, error) {
+		if attempts.Add(1) == 1 {
+			<-ctx.Done()
+			return 0, ctx.Err()
+		}
+		return n * 2, nil
+	}
+
+	circuit, err := WrapOf(effector).
+		WithTimeout(20 * time.Millisecond).
+		WithRetry(RetryOptions{Retries: 2, Delay: time.Millisecond}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := circuit(context.Background(), 21)
+	if err != nil || res != 42 {
+		t.Errorf("expected 42, got %d, %v", res, err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+}
+
+// TestPolicyTimeoutIgnoredContext verifies that the timeout layer returns
+// on time even when the effector ignores its context.
+func TestPolicyTimeoutIgnoredContext(t *testing.T) {
+	slow := func(ctx context.Context) (string, error) {
+		time.Sleep(500 * time.Millisecond)
+		return "late", nil
+	}
+
+	e, err := BuildEffector(Wrap(slow).WithTimeout(20 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	res, err := e(context.Background())
+
+	if !errors.Is(err, ErrTimeout) || res != "" {
+		t.Errorf("expected a timeout error; got %q, %v", res, err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Error("expected to return after about 20ms; took", elapsed)
+	}
+}
+
+// TestPolicyFallbackOutermost verifies that the fallback sees the error
+// after retries have been exhausted.
+func TestPolicyFallbackOutermost(t *testing.T) {
+	attempts := 0
+	effector := func(ctx context.Context, _ string) (string, error) {
+		attempts++
+		return "", errors.New("down")
+	}
+	fallback := func(ctx context.Context, _ string) (string, error) {
+		return "cached", nil
+	}
+
+	circuit, err := WrapOf(effector).
+		WithFallback(fallback, nil).
+		WithRetry(RetryOptions{Retries: 2, Delay: time.Millisecond}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := circuit(context.Background(), "key")
+	if err != nil || res != "cached" {
+		t.Errorf("expected cached, got %q, %v", res, err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+// TestPolicyValidate verifies that incompatible combinations are rejected by Build.
+func TestPolicyValidate(t *testing.T) {
+	effector := func(ctx context.Context) (string, error) { return "ok", nil }
+
+	tests := []struct {
+		name   string
+		policy *Policy[struct{}, string]
+		want   string
+	}{
+		{"duplicate", Wrap(effector).WithTimeout(time.Second).WithTimeout(time.Second), "more than once"},
+		{"non-positive timeout", Wrap(effector).WithTimeout(0), "must be positive"},
+		{"unbounded retry", Wrap(effector).WithRetry(RetryOptions{Unlimited: true}), "unlimited Retry"},
+		{"retry shorter than timeout", Wrap(effector).
+			WithRetry(RetryOptions{Retries: 3, MaxElapsed: time.Second}).
+			WithTimeout(2 * time.Second), "shorter than Timeout"},
+		{"retry and hedge", Wrap(effector).
+			WithRetry(RetryOptions{Retries: 3}).
+			WithHedge(HedgeOptions{Delay: time.Millisecond}), "Retry and Hedge"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.policy.Build()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
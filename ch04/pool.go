@@ -0,0 +1,163 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// ErrPoolClosed は、Close されたワーカープールにタスクを投入しようとしたことを表すエラーです。
+var ErrPoolClosed = errors.New("worker pool is closed")
+
+// PoolSettings は Pool の設定です。
+type PoolSettings struct {
+	// Workers はタスクを並行して実行するゴルーチンの数です。0 の場合は GOMAXPROCS の値を使います。
+	Workers int
+
+	// QueueSize は、実行を待つタスクの数の上限です。
+	// 待ち行列が埋まっている間、Submit は空きができるまで待機します。0 の場合は待ち行列を持ちません。
+	QueueSize int
+}
+
+// Pool は、一定数のゴルーチンでタスクを実行するワーカープールです。
+type Pool struct {
+	settings PoolSettings
+	tasks    chan func()
+	wg       sync.WaitGroup
+
+	m          sync.RWMutex
+	closed     bool
+	closing    chan struct{}  // Close で閉じられ、待機中の Submit を終わらせる
+	submitting sync.WaitGroup // tasks に送ろうとしている Submit
+	closeTasks sync.Once
+}
+
+// NewPool は settings に従ってワーカーを起動した Pool を返します。
+func NewPool(settings PoolSettings) *Pool {
+	if settings.Workers <= 0 {
+		settings.Workers = runtime.GOMAXPROCS(0)
+	}
+	if settings.QueueSize < 0 {
+		settings.QueueSize = 0
+	}
+
+	p := &Pool{
+		settings: settings,
+		tasks:    make(chan func(), settings.QueueSize),
+		closing:  make(chan struct{}),
+	}
+
+	p.wg.Add(settings.Workers)
+	for range settings.Workers {
+		go p.work()
+	}
+
+	return p
+}
+
+// work は tasks が閉じられるまでタスクを実行します。
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	for task := range p.tasks {
+		task()
+	}
+}
+
+// Submit はタスクを投入します。ワーカーと待ち行列が埋まっている場合は空きができるまで待機し、
+// 先に ctx が終了した場合は ctx.Err() を返します。Close の後は ErrPoolClosed を返します。
+// Close されると、待機中の Submit も ErrPoolClosed を返します。
+func (p *Pool) Submit(ctx context.Context, task func()) error {
+	if !p.enter() {
+		return ErrPoolClosed
+	}
+	defer p.submitting.Done()
+
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-p.closing:
+		return ErrPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enter は、Close されていなければ submitting に加えて true を返します。
+// ロックは tasks に送る前に解放するため、Close は待機中の Submit を待たずに進めます。
+func (p *Pool) enter() bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	if p.closed {
+		return false
+	}
+
+	p.submitting.Add(1)
+
+	return true
+}
+
+// TrySubmit は、待機せずに受け付けられる場合だけタスクを投入し、受け付けたかどうかを返します。
+func (p *Pool) TrySubmit(task func()) bool {
+	if !p.enter() {
+		return false
+	}
+	defer p.submitting.Done()
+
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queued は実行を待っているタスクの数を返します。
+func (p *Pool) Queued() int {
+	return len(p.tasks)
+}
+
+// Close は新しいタスクの受け付けを止め、投入済みのタスクが全て終わるまで待ちます。
+// 先に ctx が終了した場合は ctx.Err() を返しますが、残りのタスクはその後も実行されます。
+func (p *Pool) Close(ctx context.Context) error {
+	p.m.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.closing)
+	}
+	p.m.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		// closing が閉じられたので、送信中の Submit はすぐに終わる
+		p.submitting.Wait()
+		p.closeTasks.Do(func() { close(p.tasks) })
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPoolBoundedConcurrency tests that no more than Workers tasks run at
+// once and that Close drains every submitted task.
+func TestPoolBoundedConcurrency(t *testing.T) {
+	p := NewPool(PoolSettings{Workers: 3, QueueSize: 5})
+
+	var running, peak, done atomic.Int32
+
+	for i := 0; i < 20; i++ {
+		err := p.Submit(context.Background(), func() {
+			n := running.Add(1)
+			for {
+				m := peak.Load()
+				if n <= m || peak.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+			done.Add(1)
+		})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if n := peak.Load(); n > 3 {
+		t.Error("expected at most 3 concurrent tasks; got", n)
+	}
+	if n := done.Load(); n != 20 {
+		t.Error("expected 20 tasks to finish; got", n)
+	}
+
+	if err := p.Submit(context.Background(), func() {}); !errors.Is(err, ErrPoolClosed) {
+		t.Error("expected ErrPoolClosed; got", err)
+	}
+}
+
+// TestPoolBackpressure tests that Submit blocks while the pool is full.
+func TestPoolBackpressure(t *testing.T) {
+	p := NewPool(PoolSettings{Workers: 1, QueueSize: 1})
+	release := make(chan struct{})
+
+	p.Submit(context.Background(), func() { <-release })
+	time.Sleep(10 * time.Millisecond) // let the worker pick up the first task
+	p.Submit(context.Background(), func() {})
+
+	if p.TrySubmit(func() {}) {
+		t.Error("expected TrySubmit to fail while the pool is full")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := p.Submit(ctx, func() {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected context.DeadlineExceeded; got", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := p.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected Close to time out while a task is running; got", err)
+	}
+
+	close(release)
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+// TestPoolCloseWithBlockedSubmit tests that Close honours its deadline while
+// a Submit is blocked on a full pool, and that the blocked Submit is released.
+func TestPoolCloseWithBlockedSubmit(t *testing.T) {
+	p := NewPool(PoolSettings{Workers: 1})
+	release := make(chan struct{})
+
+	p.Submit(context.Background(), func() { <-release })
+
+	submitted := make(chan error, 1)
+	go func() {
+		submitted <- p.Submit(context.Background(), func() {})
+	}()
+	time.Sleep(10 * time.Millisecond) // let the Submit block
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := p.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected context.DeadlineExceeded; got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("expected Close to return at its deadline; took", elapsed)
+	}
+
+	if err := <-submitted; !errors.Is(err, ErrPoolClosed) {
+		t.Error("expected the blocked Submit to get ErrPoolClosed; got", err)
+	}
+
+	close(release)
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoPromises は、Any や Race に Promise が1つも渡されなかったことを表すエラーです。
+var ErrNoPromises = errors.New("no promises")
+
+// Promise は、非同期に計算される T 型の値です。
+// Future の型パラメータ版で、*Promise[string] は Future を実装します。
+type Promise[T any] struct {
+	ctx  context.Context // 後続の処理に引き継ぐコンテキスト
+	once sync.Once
+	done chan struct{}
+
+	value T
+	err   error
+}
+
+// newPromise はまだ値が決まっていない Promise を作成します。
+func newPromise[T any](ctx context.Context) *Promise[T] {
+	return &Promise[T]{ctx: ctx, done: make(chan struct{})}
+}
+
+// resolve は Promise の値を決めます。2回目以降の呼び出しは無視されます。
+func (p *Promise[T]) resolve(value T, err error) {
+	p.once.Do(func() {
+		p.value, p.err = value, err
+		close(p.done)
+	})
+}
+
+// Go は、f を新しいゴルーチンで ctx とともに実行し、その結果の Promise を返します。
+func Go[T any](ctx context.Context, f func(context.Context) (T, error)) *Promise[T] {
+	p := newPromise[T](ctx)
+
+	go func() {
+		p.resolve(f(ctx))
+	}()
+
+	return p
+}
+
+// Resolved は value で完了した Promise を返します。
+func Resolved[T any](value T) *Promise[T] {
+	p := newPromise[T](context.Background())
+	p.resolve(value, nil)
+	return p
+}
+
+// Rejected は err で失敗した Promise を返します。
+func Rejected[T any](err error) *Promise[T] {
+	var zero T
+	p := newPromise[T](context.Background())
+	p.resolve(zero, err)
+	return p
+}
+
+// Done は Promise が完了すると閉じられるチャネルを返します。
+func (p *Promise[T]) Done() <-chan struct{} {
+	return p.done
+}
+
+// Await は Promise が完了するまで待ち、その値とエラーを返します。
+// 先に ctx が終了した場合は ctx.Err() を返しますが、Promise の計算は取り消されません。
+func (p *Promise[T]) Await(ctx context.Context) (T, error) {
+	select {
+	case <-p.done:
+		return p.value, p.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Result は Promise が完了するまで待ち、その値とエラーを返します。
+func (p *Promise[T]) Result() (T, error) {
+	<-p.done
+	return p.value, p.err
+}
+
+// Catch は、p が失敗した場合に f でエラーから回復する Promise を返します。
+// p が成功した場合はその値をそのまま返します。p が完了する前に p のコンテキストが
+// 終了した場合、f は実行されずにコンテキストのエラーで失敗します。
+func (p *Promise[T]) Catch(f func(error) (T, error)) *Promise[T] {
+	return Go(p.ctx, func(ctx context.Context) (T, error) {
+		value, err := p.Await(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return value, ctx.Err()
+			}
+			return f(err)
+		}
+		return value, nil
+	})
+}
+
+// WithTimeout は、p が d 以内に完了しなければ TimeoutError で失敗する Promise を返します。
+// 先に p のコンテキストが終了した場合は、コンテキストのエラーで失敗します。
+func (p *Promise[T]) WithTimeout(d time.Duration) *Promise[T] {
+	return Go(p.ctx, func(ctx context.Context) (T, error) {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-p.done:
+			return p.value, p.err
+		case <-timer.C:
+			var zero T
+			return zero, &TimeoutError{Timeout: d}
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	})
+}
+
+// Then は、p が成功した場合にその値で f を実行する Promise を返します。
+// p が失敗した場合や、p が完了する前に p のコンテキストが終了した場合、
+// f は実行されずにそのエラーで失敗します。
+func Then[T, U any](p *Promise[T], f func(context.Context, T) (U, error)) *Promise[U] {
+	return Go(p.ctx, func(ctx context.Context) (U, error) {
+		value, err := p.Await(ctx)
+		if err != nil {
+			var zero U
+			return zero, err
+		}
+		return f(ctx, value)
+	})
+}
+
+// Map は、p が成功した場合にその値を f で変換する Promise を返します。
+func Map[T, U any](p *Promise[T], f func(T) U) *Promise[U] {
+	return Then(p, func(ctx context.Context, value T) (U, error) {
+		return f(value), nil
+	})
+}
+
+// All は、全ての Promise が成功すると、その値を同じ順序で並べたスライスで完了する Promise を返します。
+// いずれかが失敗した場合は、他の完了を待たずにそのエラーで失敗します。
+func All[T any](promises ...*Promise[T]) *Promise[[]T] {
+	return Go(context.Background(), func(ctx context.Context) ([]T, error) {
+		values := make([]T, len(promises))
+		settled := settle(promises)
+
+		for range promises {
+			s := <-settled
+			if s.err != nil {
+				return nil, s.err
+			}
+			values[s.index] = s.value
+		}
+
+		return values, nil
+	})
+}
+
+// Any は、最初に成功した Promise の値で完了する Promise を返します。
+// 全てが失敗した場合は、全てのエラーをまとめたエラーで失敗します。
+func Any[T any](promises ...*Promise[T]) *Promise[T] {
+	if len(promises) == 0 {
+		return Rejected[T](ErrNoPromises)
+	}
+
+	return Go(context.Background(), func(ctx context.Context) (T, error) {
+		errs := make([]error, len(promises))
+		settled := settle(promises)
+
+		for range promises {
+			s := <-settled
+			if s.err == nil {
+				return s.value, nil
+			}
+			errs[s.index] = s.err
+		}
+
+		var zero T
+		return zero, errors.Join(errs...)
+	})
+}
+
+// Race は、最初に完了した Promise と同じ値とエラーで完了する Promise を返します。
+func Race[T any](promises ...*Promise[T]) *Promise[T] {
+	if len(promises) == 0 {
+		return Rejected[T](ErrNoPromises)
+	}
+
+	return Go(context.Background(), func(ctx context.Context) (T, error) {
+		s := <-settle(promises)
+		return s.value, s.err
+	})
+}
+
+// settled は、完了した Promise の位置と結果です。
+type settled[T any] struct {
+	index int
+	value T
+	err   error
+}
+
+// settle は、promises が完了した順にその結果を送るチャネルを返します。
+// チャネルには全ての結果を入れられるだけのバッファがあるため、読み残してもゴルーチンは終了します。
+func settle[T any](promises []*Promise[T]) <-chan settled[T] {
+	ch := make(chan settled[T], len(promises))
+
+	for i, p := range promises {
+		go func() {
+			value, err := p.Result()
+			ch <- settled[T]{i, value, err}
+		}()
+	}
+
+	return ch
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// after returns a Promise that resolves to value, or fails with err, after d.
+func after[T any](d time.Duration, value T, err error) *Promise[T] {
+	return Go(context.Background(), func(ctx context.Context) (T, error) {
+		time.Sleep(d)
+		return value, err
+	})
+}
+
+// TestPromiseAwait tests that Await returns the value, and that it returns
+// early when its context ends without cancelling the Promise.
+func TestPromiseAwait(t *testing.T) {
+	p := after(50*time.Millisecond, 42, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := p.Await(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected context.DeadlineExceeded; got", err)
+	}
+
+	if n, err := p.Await(context.Background()); err != nil || n != 42 {
+		t.Errorf("expected 42; got %d, %v", n, err)
+	}
+
+	var _ Future = Resolved("ok")
+}
+
+// TestPromiseThenMapCatch tests composition of Promises.
+func TestPromiseThenMapCatch(t *testing.T) {
+	p := Then(Resolved(21), func(ctx context.Context, n int) (int, error) {
+		return n * 2, nil
+	})
+	s := Map(p, strconv.Itoa)
+
+	if res, err := s.Result(); err != nil || res != "42" {
+		t.Errorf("expected \"42\"; got %q, %v", res, err)
+	}
+
+	errDown := errors.New("down")
+	called := false
+	failed := Then(Rejected[int](errDown), func(ctx context.Context, n int) (int, error) {
+		called = true
+		return n, nil
+	})
+
+	if _, err := failed.Result(); !errors.Is(err, errDown) || called {
+		t.Errorf("expected the error to skip Then; got %v, called=%v", err, called)
+	}
+
+	recovered := failed.Catch(func(err error) (int, error) {
+		return -1, nil
+	})
+
+	if n, err := recovered.Result(); err != nil || n != -1 {
+		t.Errorf("expected -1; got %d, %v", n, err)
+	}
+}
+
+// TestPromiseAll tests that All collects values in order and fails fast.
+func TestPromiseAll(t *testing.T) {
+	values, err := All(
+		after(30*time.Millisecond, 1, nil),
+		after(10*time.Millisecond, 2, nil),
+		Resolved(3),
+	).Result()
+	if err != nil || len(values) != 3 || values[0] != 1 || values[1] != 2 || values[2] != 3 {
+		t.Errorf("expected [1 2 3]; got %v, %v", values, err)
+	}
+
+	errDown := errors.New("down")
+	start := time.Now()
+
+	_, err = All(after(time.Second, 1, nil), after(10*time.Millisecond, 0, errDown)).Result()
+	if !errors.Is(err, errDown) {
+		t.Error("expected the error; got", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("expected All to fail without waiting for the slow Promise")
+	}
+}
+
+// TestPromiseAnyRace tests Any and Race.
+func TestPromiseAnyRace(t *testing.T) {
+	errDown := errors.New("down")
+
+	n, err := Any(Rejected[int](errDown), after(20*time.Millisecond, 2, nil)).Result()
+	if err != nil || n != 2 {
+		t.Errorf("expected Any to return 2; got %d, %v", n, err)
+	}
+
+	_, err = Any(Rejected[int](errDown), Rejected[int](errors.New("also down"))).Result()
+	if !errors.Is(err, errDown) {
+		t.Error("expected Any to join the errors; got", err)
+	}
+
+	_, err = Race(Rejected[int](errDown), after(20*time.Millisecond, 2, nil)).Result()
+	if !errors.Is(err, errDown) {
+		t.Error("expected Race to return the first error; got", err)
+	}
+
+	if _, err := Race[int]().Result(); !errors.Is(err, ErrNoPromises) {
+		t.Error("expected ErrNoPromises; got", err)
+	}
+}
+
+// TestPromiseWithTimeout tests that WithTimeout fails a slow Promise.
+func TestPromiseWithTimeout(t *testing.T) {
+	_, err := after(time.Second, 1, nil).WithTimeout(10 * time.Millisecond).Result()
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("expected ErrTimeout; got", err)
+	}
+
+	n, err := Resolved(1).WithTimeout(time.Second).Result()
+	if err != nil || n != 1 {
+		t.Errorf("expected 1; got %d, %v", n, err)
+	}
+}
+
+// TestPromiseChainCanceled tests that Then, Catch and WithTimeout stop
+// waiting once the Promise's context ends, even if the Promise never does.
+func TestPromiseChainCanceled(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := Go(ctx, func(ctx context.Context) (int, error) {
+		<-block
+		return 0, nil
+	})
+
+	then := Then(p, func(ctx context.Context, n int) (int, error) { return n, nil })
+	caught := p.Catch(func(err error) (int, error) { return 0, nil })
+	timed := p.WithTimeout(time.Hour)
+
+	cancel()
+
+	for name, q := range map[string]*Promise[int]{"Then": then, "Catch": caught, "WithTimeout": timed} {
+		wait, stop := context.WithTimeout(context.Background(), time.Second)
+		if _, err := q.Await(wait); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected context.Canceled; got %v", name, err)
+		}
+		stop()
+	}
+}
@@ -18,7 +18,7 @@ package ch04
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"time"
 )
 
@@ -26,21 +26,155 @@ import (
 // retries はリトライ回数を指定し、delay で各リトライ間の待機時間を指定します。
 // コンテキストの終了シグナルを監視し、キャンセル時に即時終了します。
 // Effector が成功した場合、すぐに結果を返し、失敗した場合はリトライを続けます。
+// 失敗した試行は slog.Default() に記録されます。
 func Retry(effector Effector, retries int, delay time.Duration) Effector {
-	return func(ctx context.Context) (string, error) {
+	return Effector(untyped(RetryOf(effector.typed(), retries, delay)))
+}
+
+// RetryOptions は RetryWith の設定です。
+type RetryOptions struct {
+	// Retries は最大のリトライ回数です。0 以下の場合はリトライしません。
+	Retries int
+
+	// Unlimited が true の場合、Retries を無視して回数を制限せずにリトライします。
+	// MaxElapsed や Budget、コンテキストの期限と組み合わせて使います。
+	Unlimited bool
+
+	// Delay は各リトライ間の待機時間です。Backoff が設定されている場合は使用されません。
+	Delay time.Duration
+
+	// Backoff は各リトライ間の待機時間を決めます。nil の場合は Delay だけ待機します。
+	Backoff Backoff
+
+	// MaxElapsed が 0 より大きい場合、最初の試行からの経過時間と次の待機時間の合計が
+	// MaxElapsed を超えるとリトライを止めて最後のエラーを返します。
+	MaxElapsed time.Duration
+
+	// Budget が設定されている場合、成功した呼び出しごとに予算を加え、
+	// リトライのたびに予算を差し引きます。予算が尽きるとリトライせずに最後のエラーを返します。
+	// 同じ Budget を複数のラッパーで共有できます。
+	Budget *RetryBudget
+
+	// Classifier はエラーをリトライすべきかどうか分類します。
+	// nil の場合は DefaultClassifier を使います。
+	Classifier Classifier
+
+	// OnRetry は、attempt 回目 (1 始まり) の試行が err で失敗し、delay 後に再試行する前に呼び出されます。
+	OnRetry func(attempt int, err error, delay time.Duration)
+
+	// OnGiveUp は、attempts 回の試行の後にリトライを諦めて err を返す前に呼び出されます。
+	// 回数や予算を使い切った場合、恒久的なエラーの場合、コンテキストが終了した場合が該当します。
+	OnGiveUp func(attempts int, err error)
+
+	// OnSuccess は、attempts 回目の試行で成功したときに呼び出されます。
+	OnSuccess func(attempts int)
+
+	// Logger が設定されている場合、各試行の結果を記録します。nil の場合は何も記録しません。
+	Logger *slog.Logger
+}
+
+// RetryOf は Retry の型パラメータ版です。
+// 各試行には同じリクエストが渡されます。
+func RetryOf[Req, Resp any](effector CircuitOf[Req, Resp], retries int, delay time.Duration) CircuitOf[Req, Resp] {
+	return RetryWith(effector, RetryOptions{Retries: retries, Delay: delay, Logger: slog.Default()})
+}
+
+// RetryWith は、opts に従って effector をリトライするラッパーを返します。
+// Classifier が OutcomeFailure と分類したエラーだけがリトライされ、
+// Permanent で包まれたエラーは包みを外して直ちに返されます。
+// エラーが RetryAfterError の場合、指示された時間よりも早くは再試行しません。
+func RetryWith[Req, Resp any](effector CircuitOf[Req, Resp], opts RetryOptions) CircuitOf[Req, Resp] {
+	backoff := opts.Backoff
+	if backoff == nil {
+		backoff = ConstantBackoff{Delay: opts.Delay}
+	}
+
+	return func(ctx context.Context, req Req) (Resp, error) {
+		start := time.Now()
+		var delay time.Duration
+
 		for r := 0; ; r++ {
-			response, err := effector(ctx)
-			if err == nil || r >= retries {
+			response, err := effector(ctx, req)
+
+			switch classify(opts.Classifier, err) {
+			case OutcomeSuccess:
+				if opts.Budget != nil {
+					opts.Budget.Deposit()
+				}
+				opts.success(ctx, r+1)
+				return response, err
+			case OutcomeIgnore:
+				return response, err
+			case OutcomePermanent:
+				err = unwrapPermanent(err)
+				opts.giveUp(ctx, r+1, err)
 				return response, err
 			}
 
-			log.Printf("Attempt %d failed; retrying in %v", r+1, delay)
+			if !opts.Unlimited && r >= opts.Retries {
+				opts.giveUp(ctx, r+1, err)
+				return response, err
+			}
+
+			delay = backoff.Next(r, delay)
+			if hint, ok := retryAfter(err); ok && hint > delay {
+				delay = hint // Honor the delay the server asked for
+			}
+			if opts.MaxElapsed > 0 && time.Since(start)+delay > opts.MaxElapsed {
+				opts.giveUp(ctx, r+1, err)
+				return response, err
+			}
+
+			if opts.Budget != nil && !opts.Budget.Withdraw() {
+				opts.giveUp(ctx, r+1, err)
+				return response, err
+			}
+
+			opts.retry(ctx, r+1, err, delay)
 
 			select {
 			case <-time.After(delay):
 			case <-ctx.Done():
-				return "", ctx.Err()
+				opts.giveUp(ctx, r+1, ctx.Err())
+				var zero Resp
+				return zero, ctx.Err()
 			}
 		}
 	}
 }
+
+// retry は OnRetry を呼び出し、再試行することを記録します。
+func (opts *RetryOptions) retry(ctx context.Context, attempt int, err error, delay time.Duration) {
+	if opts.Logger != nil {
+		opts.Logger.LogAttrs(ctx, slog.LevelWarn, "attempt failed; retrying",
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", delay),
+			slog.Any("error", err))
+	}
+	if opts.OnRetry != nil {
+		opts.OnRetry(attempt, err, delay)
+	}
+}
+
+// giveUp は OnGiveUp を呼び出し、リトライを諦めたことを記録します。
+func (opts *RetryOptions) giveUp(ctx context.Context, attempts int, err error) {
+	if opts.Logger != nil {
+		opts.Logger.LogAttrs(ctx, slog.LevelError, "giving up",
+			slog.Int("attempts", attempts),
+			slog.Any("error", err))
+	}
+	if opts.OnGiveUp != nil {
+		opts.OnGiveUp(attempts, err)
+	}
+}
+
+// success は OnSuccess を呼び出し、成功したことを記録します。
+func (opts *RetryOptions) success(ctx context.Context, attempts int) {
+	if opts.Logger != nil {
+		opts.Logger.LogAttrs(ctx, slog.LevelDebug, "attempt succeeded",
+			slog.Int("attempts", attempts))
+	}
+	if opts.OnSuccess != nil {
+		opts.OnSuccess(attempts)
+	}
+}
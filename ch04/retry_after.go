@@ -0,0 +1,118 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryAfterError は、次の試行まで待機すべき時間をサーバーなどから
+// 指示されたエラーです。Retry はこの時間よりも早く再試行しません。
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// retryAfter は err が RetryAfterError を含んでいれば、指示された待機時間を返します。
+func retryAfter(err error) (time.Duration, bool) {
+	var rerr RetryAfterError
+	if errors.As(err, &rerr) {
+		return rerr.RetryAfter(), true
+	}
+	return 0, false
+}
+
+// HTTPError は、HTTP レスポンスがエラーのステータスコードを返したことを表すエラーです。
+type HTTPError struct {
+	StatusCode int
+	Status     string
+
+	// Delay は Retry-After ヘッダーで指示された待機時間です。指示がなければ 0 です。
+	Delay time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	if e.Delay > 0 {
+		return fmt.Sprintf("http status %s (retry after %v)", e.Status, e.Delay)
+	}
+	return "http status " + e.Status
+}
+
+// RetryAfter は Retry-After ヘッダーで指示された待機時間を返します。
+func (e *HTTPError) RetryAfter() time.Duration {
+	return e.Delay
+}
+
+// CheckResponse は、resp のステータスコードが 400 以上の場合に *HTTPError を返します。
+// ステータスコードが 429 (Too Many Requests) か 503 (Service Unavailable) で
+// Retry-After ヘッダーがある場合、その待機時間を HTTPError.Delay に設定します。
+// 408 (Request Timeout) と 429 以外の 4xx はリトライしても回復しないため、Permanent で包んで返します。
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+
+	err := &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	if err.Status == "" {
+		err.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if d, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			err.Delay = d
+		}
+	}
+
+	if resp.StatusCode < http.StatusInternalServerError &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+
+	return err
+}
+
+// ParseRetryAfter は Retry-After ヘッダーの値を待機時間に変換します。
+// 値は秒数か HTTP-date のどちらかで、HTTP-date の場合は now からの差を返します。
+// 値が解釈できない場合は false を返します。
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		// 大きすぎる値で time.Duration が桁あふれしないように丸めます。
+		seconds = min(seconds, math.MaxInt64/int64(time.Second))
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+
+	return 0, false
+}
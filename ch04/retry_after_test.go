@@ -0,0 +1,138 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestParseRetryAfter tests parsing of delta-seconds and HTTP-date values.
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Mon, 01 Jan 2024 00:00:30 GMT", 30 * time.Second, true},
+		{"Sun, 31 Dec 2023 23:59:00 GMT", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"99999999999", time.Duration(math.MaxInt64/int64(time.Second)) * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseRetryAfter(%q): expected %v, %v; got %v, %v", tt.value, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+// TestRetryHonorsRetryAfter tests that Retry waits for the delay requested
+// by a 429 response rather than its own, shorter, delay.
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	get := func(ctx context.Context, url string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		if err := CheckResponse(resp); err != nil {
+			return "", err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	r := RetryOf(get, 3, 10*time.Millisecond)
+
+	start := time.Now()
+	res, err := r(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if res != "ok" {
+		t.Error("unexpected result:", res)
+	}
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Error("expected to wait at least 1s; got", elapsed)
+	}
+}
+
+// TestCheckResponse tests that only 429 and 503 responses carry the
+// Retry-After delay, and that 4xx responses other than 408 and 429 are
+// permanent.
+func TestCheckResponse(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"5"}}
+
+	if err := CheckResponse(&http.Response{StatusCode: http.StatusOK, Header: header}); err != nil {
+		t.Error("expected no error; got", err)
+	}
+
+	err := CheckResponse(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: header})
+	if d, ok := retryAfter(err); !ok || d != 5*time.Second {
+		t.Errorf("expected a 5s retry-after error; got %v", err)
+	}
+
+	err = CheckResponse(&http.Response{StatusCode: http.StatusInternalServerError, Header: header})
+	if d, _ := retryAfter(err); err == nil || d != 0 {
+		t.Errorf("expected an error without a delay; got %v", err)
+	}
+
+	for _, code := range []int{http.StatusBadRequest, http.StatusNotFound} {
+		if err := CheckResponse(&http.Response{StatusCode: code}); !IsPermanent(err) {
+			t.Errorf("expected a permanent error for %d; got %v", code, err)
+		}
+	}
+
+	for _, code := range []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError} {
+		if err := CheckResponse(&http.Response{StatusCode: code}); err == nil || IsPermanent(err) {
+			t.Errorf("expected a retryable error for %d; got %v", code, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import "sync"
+
+// RetryBudget は、複数のリトライで共有されるリトライ回数の予算です。
+// 成功した呼び出しごとに ratio 回分のリトライが予算に加えられ、リトライのたびに
+// 1 回分が差し引かれます。これにより、障害時でもリトライの総量は成功した
+// 呼び出しの ratio 倍 (と蓄えられた max 回分) に抑えられます。
+type RetryBudget struct {
+	ratio float64
+	max   float64
+
+	m      sync.Mutex
+	tokens float64
+}
+
+// NewRetryBudget は、成功した呼び出し1回につき ratio 回分のリトライを許可する
+// RetryBudget を作成します。予算は max 回分まで蓄えられ、作成時点では満杯です。
+// 例えば ratio を 0.1 にすると、リトライは成功した呼び出しの 10% 程度に制限されます。
+func NewRetryBudget(ratio float64, max int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, max: float64(max), tokens: float64(max)}
+}
+
+// Deposit は、成功した呼び出し1回分のリトライを予算に加えます。
+func (b *RetryBudget) Deposit() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+// Withdraw は、予算から1回分のリトライを差し引きます。
+// 予算が足りない場合は何もせず false を返します。
+func (b *RetryBudget) Withdraw() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// Available は、現在の予算で可能なリトライの回数を返します。
+func (b *RetryBudget) Available() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return int(b.tokens)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// TestRetryBudget tests that deposits are capped at max and withdrawals fail
+// once the budget is exhausted.
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.5, 2)
+
+	if !budget.Withdraw() || !budget.Withdraw() {
+		t.Fatal("expected the initial budget to allow 2 retries")
+	}
+	if budget.Withdraw() {
+		t.Fatal("expected the budget to be exhausted")
+	}
+
+	budget.Deposit()
+	if budget.Withdraw() {
+		t.Error("expected half a token not to allow a retry")
+	}
+
+	budget.Deposit()
+	budget.Deposit()
+	if budget.Available() != 1 {
+		t.Error("expected 1 available retry; got", budget.Available())
+	}
+
+	for i := 0; i < 10; i++ {
+		budget.Deposit()
+	}
+	if budget.Available() != 2 {
+		t.Error("expected the budget to be capped at 2; got", budget.Available())
+	}
+}
+
+// TestRetryBudgetShared tests that a budget shared by many Retry wrappers
+// limits the total number of retries.
+func TestRetryBudgetShared(t *testing.T) {
+	budget := NewRetryBudget(0.1, 10)
+
+	var m sync.Mutex
+	attempts := 0
+
+	failing := func(ctx context.Context, _ int) (string, error) {
+		m.Lock()
+		attempts++
+		m.Unlock()
+		return "", errors.New("error")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := RetryWith(failing, RetryOptions{Retries: 5, Budget: budget})
+			r(context.Background(), i)
+		}(i)
+	}
+	wg.Wait()
+
+	// 100 initial attempts plus the 10 retries held in the budget.
+	if attempts != 110 {
+		t.Error("expected 110 attempts; got", attempts)
+	}
+}
@@ -17,9 +17,12 @@
 package ch04
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"testing"
 	"time"
 )
@@ -47,3 +50,127 @@ func TestRetry(t *testing.T) {
 
 	fmt.Println(res, err)
 }
+
+// TestRetryOf は RetryOf が型付きのリクエストを各試行に渡し、
+// 成功するまでリトライすることを確認します。
+func TestRetryOf(t *testing.T) {
+	attempts := 0
+	effector := func(ctx context.Context, b []byte) (int, error) {
+		attempts++
+		if attempts < 3 {
+			return 0, errors.New("error")
+		}
+		return len(b), nil
+	}
+
+	r := RetryOf(effector, 5, 10*time.Millisecond)
+	res, err := r(context.Background(), []byte("hello"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if res != 5 {
+		t.Error("expected 5; got", res)
+	}
+	if attempts != 3 {
+		t.Error("expected 3 attempts; got", attempts)
+	}
+}
+
+// TestRetryNegativeRetries tests that a negative retry count makes a single
+// attempt, as it always has.
+func TestRetryNegativeRetries(t *testing.T) {
+	attempts := 0
+	r := Retry(func(ctx context.Context) (string, error) {
+		attempts++
+		return "", errors.New("error")
+	}, -1, time.Millisecond)
+
+	if _, err := r(context.Background()); err == nil {
+		t.Error("expected an error")
+	}
+	if attempts != 1 {
+		t.Error("expected 1 attempt; got", attempts)
+	}
+}
+
+// TestRetryUnlimited tests that Unlimited retries until MaxElapsed.
+func TestRetryUnlimited(t *testing.T) {
+	attempts := 0
+	r := RetryWith(func(ctx context.Context, _ struct{}) (string, error) {
+		attempts++
+		return "", errors.New("error")
+	}, RetryOptions{Unlimited: true, Delay: time.Millisecond, MaxElapsed: 50 * time.Millisecond})
+
+	if _, err := r(context.Background(), struct{}{}); err == nil {
+		t.Error("expected an error")
+	}
+	if attempts < 5 {
+		t.Error("expected many attempts; got", attempts)
+	}
+}
+
+// TestRetryHooks は OnRetry、OnGiveUp、OnSuccess がそれぞれ期待どおりの回数と
+// 引数で呼び出されることを確認します。
+func TestRetryHooks(t *testing.T) {
+	var retries, giveUps, successes []int
+
+	opts := RetryOptions{
+		Retries: 2,
+		Delay:   time.Millisecond,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			retries = append(retries, attempt)
+		},
+		OnGiveUp: func(attempts int, err error) {
+			giveUps = append(giveUps, attempts)
+		},
+		OnSuccess: func(attempts int) {
+			successes = append(successes, attempts)
+		},
+	}
+
+	attempts := 0
+	flaky := RetryWith(func(ctx context.Context, _ struct{}) (string, error) {
+		attempts++
+		if attempts < 2 {
+			return "", errors.New("error")
+		}
+		return "success", nil
+	}, opts)
+
+	failing := RetryWith(func(ctx context.Context, _ struct{}) (string, error) {
+		return "", errors.New("error")
+	}, opts)
+
+	flaky(context.Background(), struct{}{})
+	failing(context.Background(), struct{}{})
+
+	if fmt.Sprint(retries) != "[1 1 2]" {
+		t.Error("unexpected OnRetry attempts:", retries)
+	}
+	if fmt.Sprint(giveUps) != "[3]" {
+		t.Error("unexpected OnGiveUp attempts:", giveUps)
+	}
+	if fmt.Sprint(successes) != "[2]" {
+		t.Error("unexpected OnSuccess attempts:", successes)
+	}
+}
+
+// TestRetryLogger は、Logger を設定した場合に試行の結果が slog で記録されることを確認します。
+func TestRetryLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	r := RetryWith(func(ctx context.Context, _ struct{}) (string, error) {
+		return "", errors.New("error")
+	}, RetryOptions{Retries: 1, Delay: time.Millisecond, Logger: logger})
+
+	r(context.Background(), struct{}{})
+
+	out := buf.String()
+	if !strings.Contains(out, `"msg":"attempt failed; retrying"`) || !strings.Contains(out, `"attempt":1`) {
+		t.Error("expected a retry record; got", out)
+	}
+	if !strings.Contains(out, `"msg":"giving up"`) || !strings.Contains(out, `"attempts":2`) {
+		t.Error("expected a give-up record; got", out)
+	}
+}
@@ -17,8 +17,7 @@
 package ch04
 
 import (
-	"hash/fnv"
-	"reflect"
+	"hash/maphash"
 	"sync"
 )
 
@@ -27,41 +26,163 @@ type Shard[K comparable, V any] struct {
 	items        map[K]V // m contains the shard's data
 }
 
-type ShardedMap[K comparable, V any] []*Shard[K, V]
+// ShardedMap is a map split into shards, each with its own lock. Copies of a
+// ShardedMap share the same shards, so a Resize is seen by every copy.
+//
+// ShardedMap used to be a slice of shards. It is now a struct, so code that
+// indexed, ranged over or took the len of a ShardedMap must use its methods
+// (Len, Keys, Shards) instead.
+type ShardedMap[K comparable, V any] struct {
+	s *shardSet[K, V]
+}
+
+// shardSet is the state shared by copies of a ShardedMap.
+type shardSet[K comparable, V any] struct {
+	sync.RWMutex // Guards shards and prev
+
+	shards []*Shard[K, V] // Shards keys are placed in
+	prev   []*Shard[K, V] // Shards keys are migrated from during Resize
+
+	hash       Hasher[K] // Maps a key to a 64-bit hash
+	consistent bool      // Place keys with JumpHash instead of hash % N
+
+	resize sync.Mutex // Serializes Resize
+}
+
+// ShardedMapOptions configures NewShardedMapWith.
+type ShardedMapOptions[K comparable] struct {
+	// Consistent places keys with JumpHash instead of hash % N, so Resize
+	// only moves about |n-old|/max(n,old) of the keys and the map stays
+	// usable while they move.
+	Consistent bool
+
+	// Hasher hashes keys. If nil, DefaultHasher is used.
+	Hasher Hasher[K]
+}
+
+// Hasher returns a 64-bit hash of key. Equal keys must have equal hashes.
+type Hasher[K comparable] func(key K) uint64
 
 // NewShardedMap creates and initializes a new ShardedMap with the specified
-// number of shards.
+// number of shards. Keys are hashed with DefaultHasher.
 func NewShardedMap[K comparable, V any](nshards int) ShardedMap[K, V] {
-	shards := make([]*Shard[K, V], nshards) // Initialize a *Shards slice
+	return NewShardedMapWith[K, V](nshards, ShardedMapOptions[K]{})
+}
 
-	for i := 0; i < nshards; i++ {
+// NewShardedMapWith creates and initializes a new ShardedMap with the
+// specified number of shards, configured by opts.
+func NewShardedMapWith[K comparable, V any](nshards int, opts ShardedMapOptions[K]) ShardedMap[K, V] {
+	if opts.Hasher == nil {
+		opts.Hasher = DefaultHasher[K]()
+	}
+
+	return ShardedMap[K, V]{s: &shardSet[K, V]{
+		shards:     newShards[K, V](nil, max(nshards, 1)),
+		hash:       opts.Hasher,
+		consistent: opts.Consistent,
+	}}
+}
+
+// newShards returns n shards, reusing the shards in old where possible.
+func newShards[K comparable, V any](old []*Shard[K, V], n int) []*Shard[K, V] {
+	shards := make([]*Shard[K, V], n) // Initialize a *Shards slice
+	copy(shards, old)
+
+	for i := len(old); i < n; i++ {
 		shard := make(map[K]V)
-		shards[i] = &Shard[K, V]{items: shard} // A ShardedMap IS a slice!
+		shards[i] = &Shard[K, V]{items: shard}
 	}
 
 	return shards
 }
 
+// seed is the maphash seed used by DefaultHasher for non-string keys.
+var seed = maphash.MakeSeed()
+
+// DefaultHasher returns a Hasher for any comparable key type. String keys
+// are hashed with 64-bit FNV-1a, so their hashes are the same in every
+// process. Other keys are hashed with maphash.Comparable, whose seed is
+// chosen when the process starts; supply your own Hasher if hashes must
+// agree across processes.
+func DefaultHasher[K comparable]() Hasher[K] {
+	var zero K
+	if _, ok := any(zero).(string); ok {
+		return func(key K) uint64 {
+			return fnv64a(any(key).(string))
+		}
+	}
+
+	return func(key K) uint64 {
+		return maphash.Comparable(seed, key)
+	}
+}
+
+// fnv64a returns the 64-bit FNV-1a hash of s without allocating.
+func fnv64a(s string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+
+	hash := uint64(offset64)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= prime64
+	}
+	return hash
+}
+
+// place returns the index in 0..n-1 of the shard a key with the given hash
+// belongs in when there are n shards.
+func (m ShardedMap[K, V]) place(hash uint64, n int) int {
+	if m.s.consistent {
+		return JumpHash(hash, n)
+	}
+	return int(hash % uint64(n)) // Mod by N to get index
+}
+
 // getShardIndex accepts a key and returns a value in 0..N-1, where N is
 // the number of shards.
 func (m ShardedMap[K, V]) getShardIndex(key K) int {
-	str := reflect.ValueOf(key).String() // Get string representation of key
-	hash := fnv.New32a()                 // Get a hash implementation from "hash/fnv"
-	hash.Write([]byte(str))              // Write bytes to the hash
-	sum := int(hash.Sum32())             // Get the resulting checksum
-	return sum % len(m)                  // Mod by len(m) to get index
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	return m.place(m.s.hash(key), len(m.s.shards))
 }
 
-// getShard accepts a key and returns a pointer to its corresponding Shard.
-func (m ShardedMap[K, V]) getShard(key K) *Shard[K, V] {
-	index := m.getShardIndex(key)
-	return m[index]
+// getShard accepts a key and returns a pointer to its corresponding Shard
+// and, during a Resize, the shard it may still be in. The second shard is nil
+// if it's the same as the first. The caller must hold the map's read lock.
+func (m ShardedMap[K, V]) getShard(key K) (*Shard[K, V], *Shard[K, V]) {
+	hash := m.s.hash(key)
+	shard := m.s.shards[m.place(hash, len(m.s.shards))]
+
+	if m.s.prev == nil {
+		return shard, nil
+	}
+
+	if prev := m.s.prev[m.place(hash, len(m.s.prev))]; prev != shard {
+		return shard, prev
+	}
+
+	return shard, nil
 }
 
 // Delete removes a value from the map. If key doesn't exist in the map,
 // this method is a no-op.
 func (m ShardedMap[K, V]) Delete(key K) {
-	shard := m.getShard(key)
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	shard, prev := m.getShard(key)
+
+	if prev != nil {
+		// Delete from prev first, so Resize can't move key back into shard.
+		prev.Lock()
+		delete(prev.items, key)
+		prev.Unlock()
+	}
+
 	shard.Lock()
 	defer shard.Unlock()
 
@@ -71,30 +192,141 @@ func (m ShardedMap[K, V]) Delete(key K) {
 // Get retrieves and returns a value from the map. If the value doesn't exist,
 // nil is returned.
 func (m ShardedMap[K, V]) Get(key K) V {
-	shard := m.getShard(key)
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	shard, prev := m.getShard(key)
+
+	if prev != nil {
+		// Holding prev's read lock keeps Resize from moving key out of prev
+		// while we look in shard.
+		prev.RLock()
+		defer prev.RUnlock()
+	}
+
 	shard.RLock()
-	defer shard.RUnlock()
+	value, ok := shard.items[key]
+	shard.RUnlock()
+
+	if !ok && prev != nil {
+		value = prev.items[key]
+	}
 
-	return shard.items[key]
+	return value
 }
 
 func (m ShardedMap[K, V]) Set(key K, value V) {
-	shard := m.getShard(key)
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	shard, prev := m.getShard(key)
+
+	shard.Lock()
+	shard.items[key] = value
+	shard.Unlock()
+
+	if prev != nil {
+		prev.Lock()
+		delete(prev.items, key)
+		prev.Unlock()
+	}
+}
+
+// GetOrCreate retrieves a value from the map. If the value doesn't exist,
+// create is called with the shard locked and its result is stored and
+// returned, so concurrent callers always observe the same value.
+func (m ShardedMap[K, V]) GetOrCreate(key K, create func() V) V {
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	shard, prev := m.getShard(key)
+
+	if prev != nil {
+		// Keep Resize from moving key out of prev until we're done.
+		prev.Lock()
+		defer prev.Unlock()
+
+		if value, ok := prev.items[key]; ok {
+			return value
+		}
+	}
+
+	shard.RLock()
+	value, ok := shard.items[key]
+	shard.RUnlock()
+
+	if ok {
+		return value
+	}
+
 	shard.Lock()
 	defer shard.Unlock()
 
+	if value, ok := shard.items[key]; ok { // Another goroutine won the race
+		return value
+	}
+
+	value = create()
 	shard.items[key] = value
+
+	return value
+}
+
+// all returns every shard currently holding keys. The caller must hold the
+// map's read lock.
+func (m ShardedMap[K, V]) all() []*Shard[K, V] {
+	if len(m.s.prev) > len(m.s.shards) {
+		return m.s.prev
+	}
+	return m.s.shards
+}
+
+// DeleteFunc removes every key/value pair for which del returns true. del is
+// called with the pair's shard locked, so it must not access the map.
+func (m ShardedMap[K, V]) DeleteFunc(del func(K, V) bool) {
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	for _, shard := range m.all() {
+		shard.Lock()
+		for key, value := range shard.items {
+			if del(key, value) {
+				delete(shard.items, key)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+// Len returns the number of key/value pairs in the map. During a Resize, a
+// key that's being written may briefly be counted twice.
+func (m ShardedMap[K, V]) Len() int {
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	n := 0
+	for _, shard := range m.all() {
+		shard.RLock()
+		n += len(shard.items)
+		shard.RUnlock()
+	}
+	return n
 }
 
 // Keys returns a list of all keys in the sharded map.
 func (m ShardedMap[K, V]) Keys() []K {
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	shards := m.all()
+
 	var keys []K         // Declare an empty keys slice
 	var mutex sync.Mutex // Mutex for write safety to keys
 
 	var wg sync.WaitGroup // Create a wait group and add a
-	wg.Add(len(m))        // wait value for each slice
+	wg.Add(len(shards))   // wait value for each slice
 
-	for _, shard := range m { // Run a goroutine for each slice in m
+	for _, shard := range shards { // Run a goroutine for each slice in m
 		go func(s *Shard[K, V]) {
 			s.RLock() // Establish a read lock on s
 
@@ -111,5 +343,32 @@ func (m ShardedMap[K, V]) Keys() []K {
 
 	wg.Wait() // Block until all goroutines are done
 
+	if m.s.prev != nil {
+		keys = dedupKeys(keys) // A key being written may be in two shards
+	}
+
 	return keys // Return combined keys slice
 }
+
+// dedupKeys removes repeated keys from keys, keeping the first of each.
+func dedupKeys[K comparable](keys []K) []K {
+	seen := make(map[K]struct{}, len(keys))
+	unique := keys[:0]
+
+	for _, key := range keys {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			unique = append(unique, key)
+		}
+	}
+
+	return unique
+}
+
+// Shards returns the number of shards.
+func (m ShardedMap[K, V]) Shards() int {
+	m.s.RLock()
+	defer m.s.RUnlock()
+
+	return len(m.s.shards)
+}
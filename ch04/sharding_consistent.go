@@ -0,0 +1,110 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+// JumpHash maps key to a bucket in 0..buckets-1 using Lamping and Veach's
+// jump consistent hash. When the number of buckets changes from n to m, only
+// about |m-n|/max(m,n) of the keys move to a different bucket.
+func JumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
+
+// Resize changes the number of shards to n and moves the keys whose shard
+// has changed.
+//
+// If the map was created with ShardedMapOptions.Consistent, keys are migrated
+// one shard at a time and Get, Set and Delete can be called while Resize
+// runs. Shards that are kept aren't copied, so only about |n-old|/max(n,old)
+// of the keys move. Otherwise nearly every key moves, and the whole map is
+// locked until they have.
+func (m ShardedMap[K, V]) Resize(n int) {
+	n = max(n, 1)
+
+	m.s.resize.Lock()
+	defer m.s.resize.Unlock()
+
+	if !m.s.consistent {
+		m.rehash(n)
+		return
+	}
+
+	m.s.Lock()
+	old := m.s.shards
+	if n == len(old) {
+		m.s.Unlock()
+		return
+	}
+	m.s.prev = old
+	m.s.shards = newShards(old[:min(n, len(old))], n)
+	shards := m.s.shards
+	m.s.Unlock()
+
+	// With JumpHash, keys only move from kept shards to new ones, or from
+	// removed shards to kept ones, so from is always locked before to, in
+	// the same order as Get locks prev and shard.
+	for i, from := range old {
+		from.Lock()
+		for key, value := range from.items {
+			j := JumpHash(m.s.hash(key), n)
+			if j == i {
+				continue
+			}
+
+			to := shards[j]
+			to.Lock()
+			if _, ok := to.items[key]; !ok { // Don't overwrite a newer Set
+				to.items[key] = value
+			}
+			to.Unlock()
+
+			delete(from.items, key)
+		}
+		from.Unlock()
+	}
+
+	m.s.Lock()
+	m.s.prev = nil
+	m.s.Unlock()
+}
+
+// rehash replaces the shards with n new ones, holding the map's lock while
+// it moves every key.
+func (m ShardedMap[K, V]) rehash(n int) {
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	if n == len(m.s.shards) {
+		return
+	}
+
+	shards := newShards[K, V](nil, n)
+	for _, shard := range m.s.shards {
+		for key, value := range shard.items {
+			shards[m.place(m.s.hash(key), n)].items[key] = value
+		}
+	}
+
+	m.s.shards = shards
+}
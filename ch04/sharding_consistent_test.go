@@ -0,0 +1,197 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestJumpHashMovement tests that growing from 10 to 11 buckets moves only
+// about 1/11 of the keys, and only into the new bucket.
+func TestJumpHashMovement(t *testing.T) {
+	const keys = 10000
+	hash := DefaultHasher[int]()
+	moved := 0
+
+	for i := 0; i < keys; i++ {
+		h := hash(i)
+		before, after := JumpHash(h, 10), JumpHash(h, 11)
+
+		if before < 0 || before >= 10 {
+			t.Fatalf("bucket %d out of range", before)
+		}
+		if before != after {
+			moved++
+			if after != 10 {
+				t.Errorf("key %d moved from %d to an existing bucket %d", i, before, after)
+			}
+		}
+	}
+
+	if ratio := float64(moved) / keys; ratio < 0.05 || ratio > 0.13 {
+		t.Errorf("expected about 9%% of keys to move; got %.1f%%", ratio*100)
+	}
+}
+
+// newConsistentMap returns a ShardedMap that places keys with JumpHash.
+func newConsistentMap[K comparable, V any](nshards int) ShardedMap[K, V] {
+	return NewShardedMapWith[K, V](nshards, ShardedMapOptions[K]{Consistent: true})
+}
+
+// TestShardingConsistentSetGetDelete tests the basic map operations with
+// jump-hash placement.
+func TestShardingConsistentSetGetDelete(t *testing.T) {
+	m := newConsistentMap[string, int](17)
+
+	truthMap := map[string]int{"alpha": 1, "beta": 2, "gamma": 3, "delta": 4}
+	for k, v := range truthMap {
+		m.Set(k, v)
+	}
+
+	for k, v := range truthMap {
+		if got := m.Get(k); got != v {
+			t.Errorf("Key mismatch on %s: expected %d, got %d", k, v, got)
+		}
+	}
+
+	m.Delete("alpha")
+
+	keys := m.Keys()
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"beta", "delta", "gamma"}) || m.Len() != 3 {
+		t.Error("unexpected keys after Delete:", keys)
+	}
+}
+
+// TestShardingConsistentResize tests that growing and shrinking keeps every
+// value and only moves the affected keys.
+func TestShardingConsistentResize(t *testing.T) {
+	const keys = 1000
+	m := newConsistentMap[int, int](8)
+
+	for i := 0; i < keys; i++ {
+		m.Set(i, i*i)
+	}
+
+	before := make([]*Shard[int, int], keys)
+	for i := 0; i < keys; i++ {
+		before[i] = m.s.shards[m.getShardIndex(i)]
+	}
+
+	m.Resize(12)
+
+	moved := 0
+	for i := 0; i < keys; i++ {
+		if m.s.shards[m.getShardIndex(i)] != before[i] {
+			moved++
+		}
+	}
+	if moved > keys/2 {
+		t.Errorf("expected about a third of the keys to move; %d of %d moved", moved, keys)
+	}
+
+	for _, n := range []int{12, 3, 1, 20} {
+		m.Resize(n)
+
+		if m.Shards() != n || m.Len() != keys {
+			t.Fatalf("after Resize(%d): %d shards, %d keys", n, m.Shards(), m.Len())
+		}
+		for i := 0; i < keys; i++ {
+			if got := m.Get(i); got != i*i {
+				t.Fatalf("after Resize(%d): key %d = %d", n, i, got)
+			}
+		}
+	}
+}
+
+// TestShardingConsistentResizeConcurrent tests that the map stays readable
+// and writable while it's being resized.
+func TestShardingConsistentResizeConcurrent(t *testing.T) {
+	const keys = 2000
+	m := newConsistentMap[int, int](4)
+
+	for i := 0; i < keys; i++ {
+		m.Set(i, 1)
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				for i := 0; i < keys; i += 7 {
+					if m.Get(i) == 0 {
+						t.Errorf("key %d missing during resize", i)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for v := 2; !stop.Load(); v++ {
+			for i := 1; i < keys; i += 11 {
+				m.Set(i, v)
+			}
+		}
+	}()
+
+	for _, n := range []int{9, 16, 5, 2, 7} {
+		m.Resize(n)
+	}
+
+	stop.Store(true)
+	wg.Wait()
+
+	if m.Len() != keys {
+		t.Errorf("expected %d keys; got %d", keys, m.Len())
+	}
+}
+
+// TestShardingResize tests that a map using hash % N placement keeps every
+// value when it's resized, and that copies of the map see the new shards.
+func TestShardingResize(t *testing.T) {
+	const keys = 1000
+	m := NewShardedMap[int, int](8)
+	alias := m
+
+	for i := 0; i < keys; i++ {
+		m.Set(i, i*i)
+	}
+
+	for _, n := range []int{12, 3, 1, 20} {
+		m.Resize(n)
+
+		if alias.Shards() != n || alias.Len() != keys {
+			t.Fatalf("after Resize(%d): %d shards, %d keys", n, alias.Shards(), alias.Len())
+		}
+		for i := 0; i < keys; i++ {
+			if got := alias.Get(i); got != i*i {
+				t.Fatalf("after Resize(%d): key %d = %d", n, i, got)
+			}
+		}
+	}
+}
@@ -17,6 +17,9 @@
 package ch04
 
 import (
+	"hash/fnv"
+	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -133,3 +136,180 @@ func TestShardingDelete(t *testing.T) {
 		t.Error("Deletion failure")
 	}
 }
+
+// TestShardingGetOrCreate tests that GetOrCreate only calls create for
+// missing keys.
+func TestShardingGetOrCreate(t *testing.T) {
+	sMap := NewShardedMap[string, int](17)
+	sMap.Set("alpha", 1)
+
+	calls := 0
+	create := func() int {
+		calls++
+		return 2
+	}
+
+	if got := sMap.GetOrCreate("alpha", create); got != 1 {
+		t.Error("expected 1; got", got)
+	}
+	if got := sMap.GetOrCreate("beta", create); got != 2 {
+		t.Error("expected 2; got", got)
+	}
+	if got := sMap.GetOrCreate("beta", create); got != 2 {
+		t.Error("expected 2; got", got)
+	}
+
+	if calls != 1 {
+		t.Error("expected create to be called once; got", calls)
+	}
+}
+
+// TestShardingDeleteFunc tests that DeleteFunc only removes matching pairs.
+func TestShardingDeleteFunc(t *testing.T) {
+	sMap := NewShardedMap[string, int](17)
+
+	for i, key := range []string{"alpha", "beta", "gamma", "delta", "epsilon"} {
+		sMap.Set(key, i)
+	}
+
+	sMap.DeleteFunc(func(key string, value int) bool {
+		return value%2 == 0
+	})
+
+	if sMap.Len() != 2 {
+		t.Error("expected 2 remaining keys; got", sMap.Len())
+	}
+	for _, key := range sMap.Keys() {
+		if sMap.Get(key)%2 == 0 {
+			t.Error("key should have been deleted:", key)
+		}
+	}
+}
+
+// point is a struct key type for the distribution tests and benchmarks.
+type point struct {
+	X, Y int
+}
+
+// checkDistribution fails the test if any of the shards holds more than 30%
+// more or less than its fair share of keys.
+func checkDistribution[K comparable](t *testing.T, keys []K) {
+	t.Helper()
+
+	const BUCKETS = 16
+
+	sMap := NewShardedMap[K, int](BUCKETS)
+	counts := make([]int, BUCKETS)
+
+	for _, key := range keys {
+		counts[sMap.getShardIndex(key)]++
+	}
+
+	mean := len(keys) / BUCKETS
+	for i, n := range counts {
+		if n < mean*7/10 || n > mean*13/10 {
+			t.Errorf("shard %d has %d keys; expected about %d (%v)", i, n, mean, counts)
+			return
+		}
+	}
+}
+
+// TestShardingDistribution tests that int, struct and string keys are spread
+// evenly across shards.
+func TestShardingDistribution(t *testing.T) {
+	const N = 16000
+
+	ints := make([]int, N)
+	points := make([]point, N)
+	strs := make([]string, N)
+
+	for i := 0; i < N; i++ {
+		ints[i] = i
+		points[i] = point{i % 128, i / 128}
+		strs[i] = "key-" + strconv.Itoa(i)
+	}
+
+	t.Run("int", func(t *testing.T) { checkDistribution(t, ints) })
+	t.Run("struct", func(t *testing.T) { checkDistribution(t, points) })
+	t.Run("string", func(t *testing.T) { checkDistribution(t, strs) })
+}
+
+// TestShardingCustomHasher tests that a user-supplied Hasher is used.
+func TestShardingCustomHasher(t *testing.T) {
+	sMap := NewShardedMapWith[int, string](4, ShardedMapOptions[int]{
+		Hasher: func(key int) uint64 { return uint64(key) },
+	})
+
+	for key := 0; key < 8; key++ {
+		if idx := sMap.getShardIndex(key); idx != key%4 {
+			t.Errorf("expected key %d in shard %d; got %d", key, key%4, idx)
+		}
+	}
+
+	sMap.Set(6, "six")
+	if got := sMap.Get(6); got != "six" {
+		t.Error("expected six; got", got)
+	}
+}
+
+// TestShardingNilHasher tests that a nil Hasher falls back to DefaultHasher
+// instead of panicking on first use.
+func TestShardingNilHasher(t *testing.T) {
+	sMap := NewShardedMapWith[point, string](4, ShardedMapOptions[point]{})
+
+	sMap.Set(point{1, 2}, "p")
+	if got := sMap.Get(point{1, 2}); got != "p" {
+		t.Error("expected p; got", got)
+	}
+}
+
+// reflectShardIndex is the original reflection-based hash, kept for
+// comparison in the benchmarks.
+func reflectShardIndex[K comparable](key K, n int) int {
+	str := reflect.ValueOf(key).String()
+	hash := fnv.New32a()
+	hash.Write([]byte(str))
+	return int(hash.Sum32()) % n
+}
+
+func BenchmarkShardingGetShardIndex(b *testing.B) {
+	const BUCKETS = 17
+
+	b.Run("int", func(b *testing.B) {
+		sMap := NewShardedMap[int, int](BUCKETS)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sMap.getShardIndex(i)
+		}
+	})
+
+	b.Run("struct", func(b *testing.B) {
+		sMap := NewShardedMap[point, int](BUCKETS)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sMap.getShardIndex(point{i, i})
+		}
+	})
+
+	b.Run("string", func(b *testing.B) {
+		sMap := NewShardedMap[string, int](BUCKETS)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sMap.getShardIndex("some-moderately-long-key")
+		}
+	})
+
+	b.Run("reflect/int", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reflectShardIndex(i, BUCKETS)
+		}
+	})
+
+	b.Run("reflect/string", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reflectShardIndex("some-moderately-long-key", BUCKETS)
+		}
+	})
+}
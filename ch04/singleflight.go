@@ -0,0 +1,131 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"sync"
+)
+
+// flight は、実行中の1つの呼び出しと、その結果を待っている呼び出し元を表します。
+type flight[Resp any] struct {
+	done     chan struct{}
+	response Resp
+	err      error
+	waiters  int // 結果を待っている呼び出し元の数
+	callers  int // この呼び出しに合流した呼び出し元の総数
+	cancel   context.CancelFunc
+}
+
+// SingleFlight は、同じリクエストによる同時の呼び出しを1回の実行にまとめます。
+// DebounceFirst と異なり、結果を保持せず、異なるリクエストの呼び出しは並行して実行されます。
+type SingleFlight[Req comparable, Resp any] struct {
+	circuit CircuitOf[Req, Resp]
+
+	m         sync.Mutex
+	flights   map[Req]*flight[Resp]
+	coalesced int
+}
+
+// Coalesce は、circuit への同時の呼び出しを1回の実行にまとめる SingleFlight を返します。
+func Coalesce(circuit Circuit) *SingleFlight[struct{}, string] {
+	return CoalesceOf(circuit.typed())
+}
+
+// CoalesceOf は Coalesce の型パラメータ版です。リクエストが等しい呼び出しがまとめられます。
+func CoalesceOf[Req comparable, Resp any](circuit CircuitOf[Req, Resp]) *SingleFlight[Req, Resp] {
+	return &SingleFlight[Req, Resp]{circuit: circuit, flights: make(map[Req]*flight[Resp])}
+}
+
+// Call は circuit を呼び出します。同じリクエストの呼び出しが実行中であれば、
+// 新たに実行せずにその結果を待ちます。
+func (s *SingleFlight[Req, Resp]) Call(ctx context.Context, req Req) (Resp, error) {
+	response, _, err := s.Do(ctx, req)
+	return response, err
+}
+
+// Do は Call と同じように circuit を呼び出し、結果を共有した呼び出し元の数も返します。
+// 結果を待っている間に ctx が終了した場合は ctx.Err() を返しますが、他の呼び出し元が
+// 待っている限り実行は続きます。全ての呼び出し元が去った場合は、実行のコンテキストがキャンセルされます。
+func (s *SingleFlight[Req, Resp]) Do(ctx context.Context, req Req) (Resp, int, error) {
+	s.m.Lock()
+
+	f, ok := s.flights[req]
+	if ok {
+		f.waiters++
+		f.callers++
+		s.coalesced++
+	} else {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight[Resp]{done: make(chan struct{}), waiters: 1, callers: 1, cancel: cancel}
+		s.flights[req] = f
+
+		go s.run(fctx, req, f)
+	}
+
+	s.m.Unlock()
+
+	select {
+	case <-f.done:
+		return f.response, f.callers, f.err
+	case <-ctx.Done():
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	f.waiters--
+	if f.waiters == 0 && s.flights[req] == f {
+		// 誰も結果を待っていないので、実行を取り消す
+		delete(s.flights, req)
+		f.cancel()
+	}
+
+	var zero Resp
+	return zero, f.callers, ctx.Err()
+}
+
+// run は req で circuit を実行し、結果を待っている呼び出し元に知らせます。
+func (s *SingleFlight[Req, Resp]) run(ctx context.Context, req Req, f *flight[Resp]) {
+	response, err := s.circuit(ctx, req)
+
+	s.m.Lock()
+	if s.flights[req] == f {
+		delete(s.flights, req)
+	}
+	f.response, f.err = response, err
+	s.m.Unlock()
+
+	f.cancel()
+	close(f.done)
+}
+
+// InFlight は実行中の呼び出しの数を返します。
+func (s *SingleFlight[Req, Resp]) InFlight() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return len(s.flights)
+}
+
+// Coalesced は、実行中の呼び出しに合流した呼び出し元の総数を返します。
+func (s *SingleFlight[Req, Resp]) Coalesced() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.coalesced
+}
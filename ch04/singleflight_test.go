@@ -0,0 +1,172 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSingleFlightCoalesces tests that concurrent identical calls share a
+// single execution and its result.
+func TestSingleFlightCoalesces(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+
+	s := CoalesceOf(func(ctx context.Context, key string) (string, error) {
+		runs.Add(1)
+		<-release
+		return "value of " + key, nil
+	})
+
+	const callers = 10
+	wg := sync.WaitGroup{}
+	shared := make([]int, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res, n, err := s.Do(context.Background(), "a")
+			if err != nil || res != "value of a" {
+				t.Errorf("unexpected result %q, %v", res, err)
+			}
+			shared[i] = n
+		}(i)
+	}
+
+	// A different key is not coalesced.
+	go s.Call(context.Background(), "b")
+
+	time.Sleep(20 * time.Millisecond)
+	if n := s.InFlight(); n != 2 {
+		t.Error("expected 2 calls in flight; got", n)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := runs.Load(); n != 2 {
+		t.Error("expected 2 runs; got", n)
+	}
+	if n := s.Coalesced(); n != callers-1 {
+		t.Errorf("expected %d coalesced callers; got %d", callers-1, n)
+	}
+	for _, n := range shared {
+		if n != callers {
+			t.Errorf("expected every caller to report %d; got %v", callers, shared)
+			break
+		}
+	}
+}
+
+// TestSingleFlightSharesError tests that an error is shared and the next
+// call runs again.
+func TestSingleFlightSharesError(t *testing.T) {
+	errDown := errors.New("down")
+	var runs atomic.Int32
+
+	s := Coalesce(func(ctx context.Context) (string, error) {
+		runs.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return "", errDown
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Call(context.Background(), struct{}{}); !errors.Is(err, errDown) {
+				t.Error("expected the shared error; got", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.Call(context.Background(), struct{}{})
+
+	if n := runs.Load(); n != 2 {
+		t.Error("expected a new run after the first completed; got", n)
+	}
+}
+
+// TestSingleFlightWaiterCancel tests that a waiter can leave without
+// cancelling the shared call, and that the call is cancelled once every
+// waiter has left.
+func TestSingleFlightWaiterCancel(t *testing.T) {
+	cancelled := make(chan error, 1)
+	release := make(chan struct{})
+
+	s := CoalesceOf(func(ctx context.Context, key int) (int, error) {
+		select {
+		case <-release:
+			return key, nil
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+			return 0, ctx.Err()
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Call(ctx, 1)
+		errs <- err
+	}()
+
+	results := make(chan int, 1)
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		res, _ := s.Call(context.Background(), 1)
+		results <- res
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Error("expected the cancelled waiter to get context.Canceled; got", err)
+	}
+
+	close(release)
+	if res := <-results; res != 1 {
+		t.Error("expected the remaining waiter to get 1; got", res)
+	}
+
+	// Once every waiter has left, the shared call is cancelled.
+	release = make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	s.Call(ctx, 2)
+
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Error("expected the shared call to be cancelled; got", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the shared call to be cancelled")
+	}
+}
@@ -18,8 +18,6 @@ package ch04
 
 import (
 	"context"
-	"fmt"
-	"sync"
 	"time"
 )
 
@@ -27,54 +25,42 @@ import (
 // 非同期処理やリトライ、スロットリングなどの機構で使用されます。
 type Effector func(context.Context) (string, error)
 
+// typed は Effector を引数を取らない CircuitOf に変換します。
+func (e Effector) typed() CircuitOf[struct{}, string] {
+	return Circuit(e).typed()
+}
+
 // Throttle は Effector を指定された最大数とリフリー数と間隔で制限する機能を持つラッパーを返します。
 // max は最大実行回数を指定し、refill はリフリー回数を指定します。
 // d はリフリー間隔を指定します。
 // コンテキストの終了シグナルを監視し、キャンセル時に即時終了します。
 // Effector が成功した場合、すぐに結果を返し、失敗した場合はリフリーを続けます。
+// トークンがない場合は、次のトークンまでの時間を持つ RateLimitError を返します。
 func Throttle(e Effector, max uint, refill uint, d time.Duration) Effector {
-	var tokens = max
-	var once sync.Once
-	var m sync.Mutex
-
-	return func(ctx context.Context) (string, error) {
-		if ctx.Err() != nil {
-			return "", ctx.Err()
-		}
-
-		once.Do(func() {
-			ticker := time.NewTicker(d)
+	return Effector(untyped(ThrottleOf(e.typed(), max, refill, d)))
+}
 
-			go func() {
-				defer ticker.Stop()
+// ThrottleOf は Throttle の型パラメータ版です。
+// トークンは TokenBucket で経過時間から計算されるため、バックグラウンドのゴルーチンを使いません。
+func ThrottleOf[Req, Resp any](e CircuitOf[Req, Resp], max uint, refill uint, d time.Duration) CircuitOf[Req, Resp] {
+	bucket := NewTokenBucket(max, refill, d)
 
-				for {
-					select {
-					case <-ctx.Done():
-						return
+	return func(ctx context.Context, req Req) (Resp, error) {
+		var zero Resp
 
-					case <-ticker.C:
-						m.Lock()
-						t := tokens + refill
-						if t > max {
-							t = max
-						}
-						tokens = t
-						m.Unlock()
-					}
-				}
-			}()
-		})
+		if ctx.Err() != nil {
+			return zero, ctx.Err()
+		}
 
-		m.Lock()
-		defer m.Unlock()
+		if !bucket.Allow() {
+			// 次のトークンまでの時間を調べるために予約し、すぐに取り消す
+			r := bucket.Reserve()
+			delay := r.Delay()
+			r.Cancel()
 
-		if tokens <= 0 {
-			return "", fmt.Errorf("too many calls")
+			return zero, &RateLimitError{Delay: delay}
 		}
 
-		tokens--
-
-		return e(ctx)
+		return e(ctx, req)
 	}
 }
@@ -174,3 +174,54 @@ func TestThrottleContextTimeout(t *testing.T) {
 		t.Error("didn't get expected error")
 	}
 }
+
+// TestThrottleOf tests that the generic ThrottleOf respects max and passes
+// typed requests through.
+func TestThrottleOf(t *testing.T) {
+	const max uint = 3
+
+	calls := 0
+	effector := func(ctx context.Context, n int) (int, error) {
+		calls++
+		return n + 1, nil
+	}
+
+	throttle := ThrottleOf(effector, max, max, time.Second)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		res, err := throttle(ctx, i)
+		if err == nil && res != i+1 {
+			t.Errorf("expected %d; got %d", i+1, res)
+		}
+	}
+
+	if calls != int(max) {
+		t.Errorf("expected %d calls; got %d", max, calls)
+	}
+}
+
+// TestThrottleRefillAfterFirstContextEnds tests that the bucket keeps
+// refilling after the context of the first caller has been cancelled.
+func TestThrottleRefillAfterFirstContextEnds(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	throttle := Throttle(effector, 1, 1, 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := throttle(ctx); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	cancel()
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err := throttle(context.Background()); err != nil {
+		t.Error("expected the bucket to have refilled; got", err)
+	}
+
+	if callsCounter != 2 {
+		t.Error("expected 2 calls; got", callsCounter)
+	}
+}
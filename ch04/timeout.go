@@ -18,6 +18,8 @@ package ch04
 
 import (
 	"context"
+	"errors"
+	"time"
 )
 
 // TimeoutFunction は、文字列を受け取り、文字列とエラーを返す関数型です。
@@ -30,32 +32,133 @@ type WithContext func(context.Context, string) (string, error)
 // 非同期処理やリトライ、スロットリングなどの機構で使用されます。
 // 最後の呼び出しか処理しないようにします。
 func Timeout(f TimeoutFunction) WithContext {
-	return func(ctx context.Context, arg string) (string, error) {
-		ch := make(chan struct {
-			result string
-			err    error
-		}, 1)
+	return WithContext(TimeoutOf(f))
+}
 
-		go func() {
-			defer close(ch)
+// TimeoutOf は Timeout の型パラメータ版です。
+// コンテキストを受け取らない関数 f を、コンテキストの終了で打ち切れる CircuitOf に変換します。
+func TimeoutOf[Req, Resp any](f func(Req) (Resp, error)) CircuitOf[Req, Resp] {
+	return TimeoutWith(f, TimeoutOptions{})
+}
 
-			res, err := f(arg)
+// TimeoutOptions は TimeoutWith の設定です。
+type TimeoutOptions struct {
+	// Timeout は呼び出しごとの制限時間です。親のコンテキストの期限とは別に適用されます。
+	// 0 の場合は親のコンテキストの終了だけで打ち切ります。
+	Timeout time.Duration
+
+	// MaxAbandoned は、打ち切られた後もゴルーチンで実行を続けうる呼び出しの上限です。
+	// 呼び出しの開始時に枠を確保し、f が返ったときに解放するため、同時に実行中の f
+	// (打ち切られたものを含む) の数がこの値を超えることはありません。
+	// 枠が空いていない間の呼び出しは ErrTooManyAbandoned で拒否されます。0 の場合は制限しません。
+	MaxAbandoned int
+}
+
+// TimeoutWith は、コンテキストを受け取らない関数 f を opts に従って打ち切れる CircuitOf に変換します。
+// f はキャンセルできないため、打ち切られた呼び出しも f が終わるまでゴルーチンで実行を続けます。
+// Timeout を過ぎた場合は TimeoutError を、親のコンテキストが終了した場合はそのエラーを返します。
+func TimeoutWith[Req, Resp any](f func(Req) (Resp, error), opts TimeoutOptions) CircuitOf[Req, Resp] {
+	type result struct {
+		response Resp
+		err      error
+	}
+
+	// slots は実行中の f の数を MaxAbandoned までに制限するセマフォです。
+	var slots chan struct{}
+	if opts.MaxAbandoned > 0 {
+		slots = make(chan struct{}, opts.MaxAbandoned)
+	}
+
+	return func(parent context.Context, arg Req) (Resp, error) {
+		var zero Resp
+
+		if slots != nil {
 			select {
-			case ch <- struct {
-				result string
-				err    error
-			}{res, err}:
-			case <-ctx.Done():
-				// コンテキストがキャンセルされた場合は早期リターン
-				return
+			case slots <- struct{}{}:
+			default:
+				return zero, ErrTooManyAbandoned
 			}
+		}
+
+		ctx, cancel := withTimeout(parent, opts.Timeout)
+		defer cancel()
+
+		ch := make(chan result, 1)
+
+		go func() {
+			res, err := f(arg)
+			if slots != nil {
+				<-slots // f が返ったので枠を解放する
+			}
+			ch <- result{res, err}
 		}()
 
 		select {
 		case res := <-ch:
-			return res.result, res.err
+			return res.response, res.err
 		case <-ctx.Done():
-			return "", ctx.Err()
+			return zero, timeoutError(parent, ctx, opts.Timeout)
 		}
 	}
 }
+
+// TimeoutAfter は、circuit の各呼び出しに d の制限時間を設定するラッパーを返します。
+func TimeoutAfter(circuit Circuit, d time.Duration) Circuit {
+	return untyped(TimeoutAfterOf(circuit.typed(), d))
+}
+
+// TimeoutAfterOf は TimeoutAfter の型パラメータ版です。
+// circuit には親のコンテキストに d の期限を加えたコンテキストが渡されます。
+// コンテキストが終了すると circuit の終了を待たずに返るため、コンテキストを無視する circuit でも
+// d を過ぎて待たされることはありません。その場合、circuit は終わるまでゴルーチンで実行を続け、結果は捨てられます。
+// d を過ぎた場合は TimeoutError を、親のコンテキストが終了した場合は
+// そのエラー (例えば context.Canceled) を返すため、両者を errors.Is で区別できます。
+func TimeoutAfterOf[Req, Resp any](circuit CircuitOf[Req, Resp], d time.Duration) CircuitOf[Req, Resp] {
+	type result struct {
+		response Resp
+		err      error
+	}
+
+	return func(parent context.Context, req Req) (Resp, error) {
+		ctx, cancel := withTimeout(parent, d)
+		defer cancel()
+
+		ch := make(chan result, 1)
+
+		go func() {
+			response, err := circuit(ctx, req)
+			ch <- result{response, err}
+		}()
+
+		select {
+		case res := <-ch:
+			if res.err != nil && ctx.Err() != nil {
+				return res.response, timeoutError(parent, ctx, d)
+			}
+			return res.response, res.err
+		case <-ctx.Done():
+			var zero Resp
+			return zero, timeoutError(parent, ctx, d)
+		}
+	}
+}
+
+// withTimeout は d が正の場合だけ期限を設定したコンテキストを返します。
+func withTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, d)
+}
+
+// timeoutError は ctx が終了した理由を表すエラーを返します。
+// 親のコンテキストが終了していればそのエラーを、そうでなければ TimeoutError を返します。
+func timeoutError(parent, ctx context.Context, d time.Duration) error {
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if d > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Timeout: d}
+	}
+	return ctx.Err()
+}
@@ -18,7 +18,10 @@ package ch04
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -61,3 +64,142 @@ func Slow(s string) (string, error) {
 	fmt.Println("Slow")
 	return "Got input: " + s, nil
 }
+
+// TestTimeoutOf は、TimeoutOf が型付きの引数と戻り値をそのまま扱えることを確認するテストです。
+func TestTimeoutOf(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	timeout := TimeoutOf(func(n int) (string, error) {
+		return fmt.Sprintf("got %d", n), nil
+	})
+
+	res, err := timeout(ctx, 42)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res != "got 42" {
+		t.Fatalf("Unexpected result: %s", res)
+	}
+}
+
+// TestTimeoutAfter は、呼び出しごとの制限時間を過ぎた場合と親のコンテキストが
+// キャンセルされた場合を区別できることを確認するテストです。
+func TestTimeoutAfter(t *testing.T) {
+	wait := func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+
+	timeout := TimeoutAfter(wait, 10*time.Millisecond)
+
+	_, err := timeout(context.Background())
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected ErrTimeout; got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond, cancel)
+
+	_, err = TimeoutAfter(wait, time.Second)(ctx)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Errorf("expected context.Canceled; got %v", err)
+	}
+
+	fast := TimeoutAfterOf(func(ctx context.Context, n int) (int, error) {
+		return n + 1, nil
+	}, time.Second)
+	if n, err := fast(context.Background(), 1); err != nil || n != 2 {
+		t.Errorf("expected 2; got %d, %v", n, err)
+	}
+}
+
+// TestTimeoutWithMaxAbandoned は、打ち切られた後も実行中の呼び出しが上限に達すると
+// 新しい呼び出しが拒否され、それらが終わると再び受け付けることを確認するテストです。
+func TestTimeoutWithMaxAbandoned(t *testing.T) {
+	release := make(chan struct{})
+
+	timeout := TimeoutWith(func(n int) (int, error) {
+		<-release
+		return n, nil
+	}, TimeoutOptions{Timeout: 10 * time.Millisecond, MaxAbandoned: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, err := timeout(context.Background(), i); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected ErrTimeout; got %v", err)
+		}
+	}
+
+	if _, err := timeout(context.Background(), 2); !errors.Is(err, ErrTooManyAbandoned) {
+		t.Fatalf("expected ErrTooManyAbandoned; got %v", err)
+	}
+
+	close(release)
+
+	// 打ち切られたゴルーチンが終わって abandoned を減らすまで、期限付きで繰り返し呼び出す
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err := timeout(context.Background(), 3)
+		if err == nil {
+			if n != 3 {
+				t.Errorf("expected 3; got %d", n)
+			}
+			return
+		}
+		if !errors.Is(err, ErrTooManyAbandoned) && !errors.Is(err, ErrTimeout) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("calls were still rejected after the abandoned calls finished: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestTimeoutWithMaxAbandonedConcurrent は、同時に多数の呼び出しがあっても、
+// 実行を続けるゴルーチンが MaxAbandoned を超えないことを確認するテストです。
+func TestTimeoutWithMaxAbandonedConcurrent(t *testing.T) {
+	const maxAbandoned = 2
+
+	release := make(chan struct{})
+	var running, peak atomic.Int32
+
+	timeout := TimeoutWith(func(n int) (int, error) {
+		n32 := running.Add(1)
+		for {
+			p := peak.Load()
+			if n32 <= p || peak.CompareAndSwap(p, n32) {
+				break
+			}
+		}
+		<-release
+		running.Add(-1)
+		return n, nil
+	}, TimeoutOptions{Timeout: 10 * time.Millisecond, MaxAbandoned: maxAbandoned})
+
+	var wg sync.WaitGroup
+	var rejected atomic.Int32
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := timeout(context.Background(), i); errors.Is(err, ErrTooManyAbandoned) {
+				rejected.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := running.Load(); n > maxAbandoned {
+		t.Errorf("expected at most %d goroutines left running; got %d", maxAbandoned, n)
+	}
+	if n := peak.Load(); n > maxAbandoned {
+		t.Errorf("expected at most %d concurrent calls of f; got %d", maxAbandoned, n)
+	}
+	if n := rejected.Load(); n < 100-maxAbandoned {
+		t.Errorf("expected at least %d rejected calls; got %d", 100-maxAbandoned, n)
+	}
+
+	close(release)
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrWaitExceedsDeadline は、トークンを待つとコンテキストの期限を過ぎてしまうため、
+// 待機せずに失敗したことを表すエラーです。
+var ErrWaitExceedsDeadline = errors.New("rate limit wait would exceed context deadline")
+
+// ErrLimiterStopped は、Stop で停止されたリミッターを使おうとしたことを表すエラーです。
+var ErrLimiterStopped = errors.New("rate limiter stopped")
+
+var _ Limiter = (*TokenBucket)(nil)
+
+// ErrNoRefill は、トークンが補充されない TokenBucket で待機しようとしたことを表すエラーです。
+var ErrNoRefill = errors.New("token bucket never refills")
+
+// TokenBucket は、最大 max 個のトークンを持ち、d ごとに refill 個のトークンを補充するバケットです。
+// トークンは経過時間から必要なときに計算されるため、バックグラウンドのゴルーチンを使いません。
+// 補充の間隔は、バケットが満杯でなくなった時点から数えます。
+type TokenBucket struct {
+	max      int
+	refill   int
+	interval time.Duration
+
+	m      sync.Mutex
+	tokens int       // 予約によって負になることがある
+	last   time.Time // 最後に補充した (または満杯だった) 時刻
+
+	stopper
+}
+
+// NewTokenBucket は、満杯の状態の TokenBucket を作成します。
+// Stop で停止すると、待機中の Wait は ErrLimiterStopped を返し、
+// 以降の Allow は false を、Wait は ErrLimiterStopped を返します。
+func NewTokenBucket(max uint, refill uint, d time.Duration) *TokenBucket {
+	return &TokenBucket{
+		max:      int(max),
+		refill:   int(refill),
+		interval: d,
+		tokens:   int(max),
+		last:     time.Now(),
+		stopper:  stopper{stopped: make(chan struct{})},
+	}
+}
+
+// advance は now までに補充されるトークンを加えます。
+// ロックを保持した状態で呼び出す必要があります。
+func (b *TokenBucket) advance(now time.Time) {
+	if b.tokens >= b.max {
+		b.last = now // 満杯の間は補充の間隔を数えない
+		return
+	}
+
+	if b.refill <= 0 || b.interval <= 0 {
+		return
+	}
+
+	intervals := int(now.Sub(b.last) / b.interval)
+	if intervals <= 0 {
+		return
+	}
+
+	b.tokens = min(b.tokens+intervals*b.refill, b.max)
+	b.last = b.last.Add(time.Duration(intervals) * b.interval)
+}
+
+// Allow は、トークンがあれば1つ消費して true を返します。
+// トークンがない場合は待機せずに false を返します。
+func (b *TokenBucket) Allow() bool {
+	if b.isStopped() {
+		return false
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.advance(time.Now())
+
+	if b.tokens <= 0 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func (b *TokenBucket) allow() (bool, time.Duration) {
+	if b.Allow() {
+		return true, 0
+	}
+
+	// 次のトークンまでの時間を調べるために予約し、すぐに取り消す
+	r := b.Reserve()
+	defer r.Cancel()
+
+	return false, r.Delay()
+}
+
+// Tokens は現在利用できるトークンの数を返します。
+func (b *TokenBucket) Tokens() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.advance(time.Now())
+
+	return max(b.tokens, 0)
+}
+
+// Reservation は TokenBucket から予約したトークンです。
+type Reservation struct {
+	bucket *TokenBucket
+	ok     bool
+	at     time.Time // トークンが利用可能になる時刻
+}
+
+// Reserve はトークンを1つ予約し、そのトークンが利用可能になる時刻を持つ Reservation を返します。
+// 呼び出し側は Delay だけ待ってから処理を行うか、Cancel で予約を取り消す必要があります。
+// バケットが補充されず、トークンも残っていない場合と、バケットが停止している場合は、
+// OK が false の Reservation を返します。
+func (b *TokenBucket) Reserve() *Reservation {
+	if b.isStopped() {
+		return &Reservation{bucket: b}
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	b.advance(now)
+
+	if b.tokens > 0 {
+		b.tokens--
+		return &Reservation{bucket: b, ok: true, at: now}
+	}
+
+	if b.refill <= 0 || b.interval <= 0 {
+		return &Reservation{bucket: b}
+	}
+
+	// このトークンの前には -b.tokens 個の予約が並んでいる
+	intervals := (-b.tokens)/b.refill + 1
+	b.tokens--
+
+	return &Reservation{bucket: b, ok: true, at: b.last.Add(time.Duration(intervals) * b.interval)}
+}
+
+// OK は予約できたかどうかを返します。
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay は予約したトークンが利用可能になるまでの時間を返します。
+func (r *Reservation) Delay() time.Duration {
+	return max(time.Until(r.at), 0)
+}
+
+// Cancel は予約を取り消し、トークンをバケットに戻します。
+func (r *Reservation) Cancel() {
+	if !r.ok {
+		return
+	}
+	r.ok = false
+
+	b := r.bucket
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.advance(time.Now())
+	b.tokens = min(b.tokens+1, b.max)
+}
+
+// Wait はトークンが利用可能になるまで待機し、トークンを1つ消費します。
+// コンテキストの期限までにトークンが利用可能にならない場合は、待機せずに
+// ErrWaitExceedsDeadline を返します。待機中にコンテキストが終了した場合は
+// 予約を取り消してコンテキストのエラーを返し、バケットが停止された場合は
+// ErrLimiterStopped を返します。
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r := b.Reserve()
+	if !r.OK() {
+		if b.isStopped() {
+			return ErrLimiterStopped
+		}
+		return ErrNoRefill
+	}
+
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && r.at.After(deadline) {
+		r.Cancel()
+		return ErrWaitExceedsDeadline
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-b.stopped:
+		r.Cancel()
+		return ErrLimiterStopped
+	}
+}
+
+// ThrottleWait は Throttle と同様に Effector の呼び出しを制限しますが、
+// トークンがない場合はエラーを返さずに次のトークンが補充されるまで待機します。
+// 待機はコンテキストの終了で打ち切られ、期限までに間に合わない場合は
+// ErrWaitExceedsDeadline を直ちに返します。
+func ThrottleWait(e Effector, max uint, refill uint, d time.Duration) Effector {
+	return Effector(untyped(ThrottleWaitOf(e.typed(), max, refill, d)))
+}
+
+// ThrottleWaitOf は ThrottleWait の型パラメータ版です。
+func ThrottleWaitOf[Req, Resp any](e CircuitOf[Req, Resp], max uint, refill uint, d time.Duration) CircuitOf[Req, Resp] {
+	bucket := NewTokenBucket(max, refill, d)
+
+	return func(ctx context.Context, req Req) (Resp, error) {
+		if err := bucket.Wait(ctx); err != nil {
+			var zero Resp
+			return zero, err
+		}
+
+		return e(ctx, req)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2024 Matthew A. Titmus
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ch04
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestTokenBucketAllow tests that the bucket allows max calls and refills
+// after the interval.
+func TestTokenBucketAllow(t *testing.T) {
+	bucket := NewTokenBucket(2, 1, 100*time.Millisecond)
+
+	if !bucket.Allow() || !bucket.Allow() {
+		t.Fatal("expected 2 calls to be allowed")
+	}
+	if bucket.Allow() {
+		t.Fatal("expected the bucket to be empty")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+
+	if !bucket.Allow() {
+		t.Error("expected the bucket to have refilled")
+	}
+	if bucket.Allow() {
+		t.Error("expected only 1 token to be refilled")
+	}
+}
+
+// TestTokenBucketReserve tests that consecutive reservations report
+// increasing delays, and that Cancel returns the token.
+func TestTokenBucketReserve(t *testing.T) {
+	bucket := NewTokenBucket(1, 1, time.Second)
+
+	if r := bucket.Reserve(); r.Delay() != 0 {
+		t.Error("expected the first reservation to be immediate; got", r.Delay())
+	}
+
+	r1 := bucket.Reserve()
+	r2 := bucket.Reserve()
+
+	if d := r1.Delay(); d <= 900*time.Millisecond || d > time.Second {
+		t.Error("expected about 1s; got", d)
+	}
+	if d := r2.Delay(); d <= 1900*time.Millisecond || d > 2*time.Second {
+		t.Error("expected about 2s; got", d)
+	}
+
+	r2.Cancel()
+	r1.Cancel()
+
+	if r := bucket.Reserve(); r.Delay() <= 900*time.Millisecond {
+		t.Error("expected cancelled reservations to be reused; got", r.Delay())
+	}
+}
+
+// TestTokenBucketWait tests that Wait blocks until a token is available.
+func TestTokenBucketWait(t *testing.T) {
+	bucket := NewTokenBucket(1, 1, 100*time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := bucket.Wait(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error("expected to wait at least 200ms; got", elapsed)
+	}
+}
+
+// TestTokenBucketWaitDeadline tests that Wait fails fast when the deadline
+// can't be met, and returns the context error when cancelled.
+func TestTokenBucketWaitDeadline(t *testing.T) {
+	bucket := NewTokenBucket(1, 1, time.Second)
+	bucket.Allow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := bucket.Wait(ctx); !errors.Is(err, ErrWaitExceedsDeadline) {
+		t.Error("expected ErrWaitExceedsDeadline; got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Error("expected to fail fast; took", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if err := bucket.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Error("expected context.Canceled; got", err)
+	}
+}
+
+// TestThrottleWait tests that ThrottleWait delays calls instead of
+// rejecting them.
+func TestThrottleWait(t *testing.T) {
+	callsCounter := 0
+	throttle := ThrottleWait(callsCountFunction(&callsCounter), 2, 2, 100*time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if _, err := throttle(ctx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	if callsCounter != 6 {
+		t.Error("expected 6 calls; got", callsCounter)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error("expected to wait at least 200ms; got", elapsed)
+	}
+}
+
+// TestTokenBucketStop tests that Stop wakes pending waiters and rejects
+// subsequent calls.
+func TestTokenBucketStop(t *testing.T) {
+	bucket := NewTokenBucket(1, 1, time.Minute)
+	bucket.Allow()
+
+	time.AfterFunc(50*time.Millisecond, bucket.Stop)
+
+	if err := bucket.Wait(context.Background()); !errors.Is(err, ErrLimiterStopped) {
+		t.Error("expected ErrLimiterStopped; got", err)
+	}
+
+	bucket.Stop()
+
+	if bucket.Allow() {
+		t.Error("expected a stopped bucket to reject calls")
+	}
+	if err := bucket.Wait(context.Background()); !errors.Is(err, ErrLimiterStopped) {
+		t.Error("expected ErrLimiterStopped; got", err)
+	}
+}
@@ -3,3 +3,7 @@ module example.com/gorilla
 go 1.24
 
 require github.com/gorilla/mux v1.8.1
+
+require ch04 v0.0.0
+
+replace ch04 => ../../ch04
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"ch04"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -50,6 +53,29 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// rateLimitMiddleware は、クライアントの IP アドレスごとにリクエストを制限するミドルウェアです。
+// 制限を超えたリクエストには、次のリクエストが可能になるまでの秒数を Retry-After ヘッダーに
+// 設定して 429 Too Many Requests を返します。
+func rateLimitMiddleware(limiter *ch04.KeyedLimiter[string]) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+
+			reservation := limiter.Reserve(host)
+			if delay := reservation.Delay(); !reservation.OK() || delay > 0 {
+				reservation.Cancel()
+				ch04.WriteError(w, &ch04.RateLimitError{Delay: delay})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // helloMuxHandler は、/ に対する GET リクエストを処理する。
 func helloMuxHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello, Mux!\n"))
@@ -132,8 +158,12 @@ func main() {
 	// gorilla/muxのルーターを作成する
 	r := mux.NewRouter()
 
+	// クライアントごとに毎秒10リクエストまでに制限する
+	limiter := ch04.NewKeyedLimiter[string](10, 10, time.Second, time.Minute)
+
 	// ミドルウェアを登録する
 	r.Use(loggingMiddleware)
+	r.Use(rateLimitMiddleware(limiter))
 
 	// ルートにハンドラーを登録する
 	r.HandleFunc("/", notAllowedHandler)
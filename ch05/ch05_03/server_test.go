@@ -0,0 +1,43 @@
+package main
+
+import (
+	"ch04"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestRateLimitMiddlewareは、クライアントごとにリクエストが制限されることをテストします。
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter := ch04.NewKeyedLimiter[string](2, 2, time.Minute, 0)
+	defer limiter.Stop()
+
+	handler := rateLimitMiddleware(limiter)(http.HandlerFunc(helloMuxHandler))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := request("192.0.2.1:1234"); rec.Code != http.StatusOK {
+			t.Errorf("expected %d; got %d", http.StatusOK, rec.Code)
+		}
+	}
+
+	rec := request("192.0.2.1:5678")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected %d; got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After 60; got %q", rec.Header().Get("Retry-After"))
+	}
+
+	if rec := request("192.0.2.2:1234"); rec.Code != http.StatusOK {
+		t.Errorf("expected another client to be allowed; got %d", rec.Code)
+	}
+}